@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// APIToken is a personal access token for scripts. The token itself is only
+// shown once, at creation; the database keeps its hash. A token acts as its
+// owner, so role checks still apply, but it can only reach the routes its
+// scopes allow (see apiTokenRouteScopes).
+type APIToken struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	Email      string             `json:"-" bson:"email"`
+	Name       string             `json:"name" bson:"name"`
+	Scopes     []string           `json:"scopes" bson:"scopes"`
+	TokenHash  string             `json:"-" bson:"token_hash"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+	ExpiresAt  time.Time          `json:"expires_at" bson:"expires_at"`
+	LastUsedAt *time.Time         `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	RevokedAt  *time.Time         `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+// apiTokenPrefix marks personal access tokens so AuthMiddleware can tell
+// them from JWTs.
+const apiTokenPrefix = "lms_pat_"
+
+const (
+	apiTokenDefaultTTL = 90 * 24 * time.Hour
+	apiTokenMaxTTL     = 365 * 24 * time.Hour
+	// last_used_at is only written when it is older than this, so a busy
+	// script does not cause a write per request.
+	apiTokenTouchInterval = time.Minute
+)
+
+// Token scopes.
+const (
+	scopeCoursesRead  = "courses:read"
+	scopeCoursesWrite = "courses:write"
+	scopeGradesRead   = "grades:read"
+	scopeGradesWrite  = "grades:write"
+	scopeUsersRead    = "users:read"
+	scopeUsersWrite   = "users:write"
+)
+
+var apiTokenScopes = []string{scopeCoursesRead, scopeCoursesWrite, scopeGradesRead, scopeGradesWrite, scopeUsersRead, scopeUsersWrite}
+
+// apiTokenRouteScopes maps "METHOD /route/pattern" to the scope a token
+// needs for it. Routes that are not listed cannot be used with a token,
+// which keeps token management and session endpoints interactive only.
+var apiTokenRouteScopes = map[string]string{
+	"POST /admin/course":                                                          scopeCoursesWrite,
+	"DELETE /admin/deletecourse/:name":                                            scopeCoursesWrite,
+	"POST /admin/course/:course/resource":                                         scopeCoursesWrite,
+	"POST /admin/courses/:course/uploadTextNote":                                  scopeCoursesWrite,
+	"POST /admin/courses/:course/assignments":                                     scopeCoursesWrite,
+	"DELETE /admin/course/:course/deleteassignment/:assignment":                   scopeCoursesWrite,
+	"GET /admin/courses/:course/staff":                                            scopeCoursesRead,
+	"POST /admin/courses/:course/staff":                                           scopeCoursesWrite,
+	"DELETE /admin/courses/:course/staff/:email":                                  scopeCoursesWrite,
+	"GET /admin/quizzes":                                                          scopeCoursesRead,
+	"POST /admin/create-quiz":                                                     scopeCoursesWrite,
+	"POST /admin/quizzes/:quizid/remind":                                          scopeCoursesWrite,
+	"GET /admin/courses/:course/assignments/:assignment/submissions":              scopeGradesRead,
+	"POST /admin/courses/:course/assignments/:assignment/students/:student/grade": scopeGradesWrite,
+	"GET /admin/submissions":                                                      scopeGradesRead,
+	"GET /admin/submissions/quiz/:quizid":                                         scopeGradesRead,
+	"GET /admin/student-progress/email/:email":                                    scopeGradesRead,
+	"GET /admin/results/email/:email/quizid/:quizid":                              scopeGradesRead,
+	"GET /admin/checkquizSubmission/:quizID/:email":                               scopeGradesRead,
+	"GET /admin/leaderboard":                                                      scopeGradesRead,
+	"GET /admin/leaderboard/search/:username":                                     scopeGradesRead,
+	"POST /admin/leaderboard/addpoint/:username":                                  scopeGradesWrite,
+	"POST /admin/leaderboard/deletepoint/:username":                               scopeGradesWrite,
+	"GET /admin/users":                                                            scopeUsersRead,
+	"GET /admin/users/:email":                                                     scopeUsersRead,
+	"GET /admin/users/:email/details":                                             scopeUsersRead,
+	"POST /admin/users/:email/details":                                            scopeUsersWrite,
+	"GET /admin/students":                                                         scopeUsersRead,
+	"PUT /admin/users/:email/role":                                                scopeUsersWrite,
+	"POST /admin/users/:email/deactivate":                                         scopeUsersWrite,
+	"POST /admin/users/:email/reactivate":                                         scopeUsersWrite,
+}
+
+var apiTokenCollection *mongo.Collection
+
+var errAPITokenInvalid = errors.New("invalid, expired or revoked API token")
+
+// initAPITokens creates the api_tokens indexes.
+func initAPITokens(ctx context.Context) error {
+	_, err := apiTokenCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+	})
+	return err
+}
+
+func validAPITokenScope(scope string) bool {
+	for _, s := range apiTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyAPIToken looks up an active token and records that it was used.
+func verifyAPIToken(ctx context.Context, tokenString string) (*APIToken, error) {
+	var token APIToken
+	now := time.Now()
+	err := apiTokenCollection.FindOne(ctx, bson.M{
+		"token_hash": hashToken(tokenString),
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": now},
+	}).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return nil, errAPITokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token.LastUsedAt == nil || token.LastUsedAt.Before(now.Add(-apiTokenTouchInterval)) {
+		if _, err := apiTokenCollection.UpdateOne(ctx, bson.M{"_id": token.ID}, bson.M{"$set": bson.M{"last_used_at": now}}); err != nil {
+			slog.Warn("Failed to record API token use", "api_token_id", token.ID.Hex(), "error", err)
+		}
+	}
+	return &token, nil
+}
+
+// apiTokenAllows reports whether the token's scopes cover the route.
+func apiTokenAllows(token *APIToken, method, route string) bool {
+	required, ok := apiTokenRouteScopes[method+" "+route]
+	if !ok {
+		return false
+	}
+	for _, scope := range token.Scopes {
+		if scope == required {
+			return true
+		}
+	}
+	return false
+}
+
+// ListAPITokens lists the caller's tokens, including revoked and expired
+// ones, newest first.
+func ListAPITokens(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := apiTokenCollection.Find(ctx, bson.M{"email": c.GetString("email")}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tokens"})
+		return
+	}
+	tokenList := []APIToken{}
+	if err := cursor.All(ctx, &tokenList); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": tokenList, "availableScopes": apiTokenScopes})
+}
+
+// CreateAPIToken issues a token for the caller. expiresInDays defaults to 90
+// and may not exceed 365.
+func CreateAPIToken(c *gin.Context) {
+	var input struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresInDays"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" || len(input.Name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required and must be at most 100 characters"})
+		return
+	}
+	if len(input.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, scope := range input.Scopes {
+		if !validAPITokenScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope " + scope, "availableScopes": apiTokenScopes})
+			return
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Strings(scopes)
+	ttl := apiTokenDefaultTTL
+	if input.ExpiresInDays != 0 {
+		ttl = time.Duration(input.ExpiresInDays) * 24 * time.Hour
+		if input.ExpiresInDays < 0 || ttl > apiTokenMaxTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expiresInDays must be between 1 and 365"})
+			return
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	tokenString := apiTokenPrefix + hex.EncodeToString(secret)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	token := APIToken{
+		ID:        primitive.NewObjectID(),
+		Email:     c.GetString("email"),
+		Name:      input.Name,
+		Scopes:    scopes,
+		TokenHash: hashToken(tokenString),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if _, err := apiTokenCollection.InsertOne(ctx, token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save token"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"message":   "Token created. Copy it now, it will not be shown again.",
+		"token":     tokenString,
+		"id":        token.ID.Hex(),
+		"name":      token.Name,
+		"scopes":    token.Scopes,
+		"expiresAt": token.ExpiresAt,
+	})
+}
+
+// revokeUserAPITokens revokes every live token of a user and returns how
+// many were revoked. A token outlives a password change otherwise.
+func revokeUserAPITokens(ctx context.Context, email string) (int64, error) {
+	filter := bson.M{
+		"email":      email,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	res, err := apiTokenCollection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// RevokeAPIToken revokes one of the caller's tokens.
+func RevokeAPIToken(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := apiTokenCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "email": c.GetString("email"), "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found or already revoked"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAPITokenAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		method string
+		route  string
+		want   bool
+	}{
+		{"read scope on a read route", []string{scopeUsersRead}, "GET", "/admin/users", true},
+		{"write scope on a write route", []string{scopeGradesWrite}, "POST", "/admin/leaderboard/addpoint/:username", true},
+		{"one of several scopes", []string{scopeCoursesRead, scopeUsersWrite}, "PUT", "/admin/users/:email/role", true},
+		{"another area", []string{scopeCoursesWrite}, "GET", "/admin/users", false},
+		// Scopes are exact, so write access does not include read access
+		{"write scope on a read route", []string{scopeUsersWrite}, "GET", "/admin/users", false},
+		{"read scope on a write route", []string{scopeUsersRead}, "POST", "/admin/users/:email/deactivate", false},
+		{"same route, other method", []string{scopeUsersRead}, "DELETE", "/admin/users/:email", false},
+		{"no scopes", nil, "GET", "/admin/users", false},
+		// Routes left out of the map are never open to tokens
+		{"token management", apiTokenScopes, "POST", "/me/tokens", false},
+		{"impersonation", apiTokenScopes, "POST", "/admin/users/:email/impersonate", false},
+		{"user deletion", apiTokenScopes, "DELETE", "/admin/users/:email", false},
+		{"logout", apiTokenScopes, "POST", "/logout", false},
+		{"concrete path", apiTokenScopes, "GET", "/admin/users/student@example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := &APIToken{Scopes: tt.scopes}
+			if got := apiTokenAllows(token, tt.method, tt.route); got != tt.want {
+				t.Errorf("apiTokenAllows(%v, %s %s) = %v, want %v", tt.scopes, tt.method, tt.route, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPITokenRouteScopes(t *testing.T) {
+	methods := map[string]bool{"GET": true, "POST": true, "PUT": true, "DELETE": true}
+	for route, scope := range apiTokenRouteScopes {
+		method, path, ok := strings.Cut(route, " ")
+		if !ok || !methods[method] || !strings.HasPrefix(path, "/") {
+			t.Errorf("%q is not \"METHOD /route\"", route)
+		}
+		if !validAPITokenScope(scope) {
+			t.Errorf("%s needs unknown scope %q", route, scope)
+		}
+	}
+	if validAPITokenScope("") || validAPITokenScope("admin") || validAPITokenScope("users:*") {
+		t.Error("validAPITokenScope accepted a scope that is not offered")
+	}
+}
+
+// AuthMiddleware looks routes up by gin's FullPath, so the map keys must be
+// patterns rather than request paths.
+func TestAPITokenAllowsFullPath(t *testing.T) {
+	token := &APIToken{Scopes: []string{scopeUsersRead}}
+	router := gin.New()
+	var allowed bool
+	router.GET("/admin/users/:email/details", func(c *gin.Context) {
+		allowed = apiTokenAllows(token, c.Request.Method, c.FullPath())
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/admin/users/student@example.com/details", nil))
+	if !allowed {
+		t.Error("users:read token refused on GET /admin/users/:email/details")
+	}
+}
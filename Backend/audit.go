@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditEvent records who changed what. The collection is append-only: the
+// server inserts events but never updates or deletes them, not even when the
+// actor's account is deleted.
+type AuditEvent struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	At         time.Time          `json:"at" bson:"at"`
+	Actor      string             `json:"actor" bson:"actor"`
+	APITokenID string             `json:"api_token_id,omitempty" bson:"api_token_id,omitempty"`
+	Action     string             `json:"action" bson:"action"`
+	TargetType string             `json:"target_type" bson:"target_type"`
+	Target     string             `json:"target" bson:"target"`
+	Course     string             `json:"course,omitempty" bson:"course,omitempty"`
+	Before     bson.M             `json:"before,omitempty" bson:"before,omitempty"`
+	After      bson.M             `json:"after,omitempty" bson:"after,omitempty"`
+	IP         string             `json:"ip" bson:"ip"`
+	UserAgent  string             `json:"user_agent" bson:"user_agent"`
+}
+
+// Audited actions.
+const (
+	auditGradeAssignment  = "assignment.grade"
+	auditDeleteAssignment = "assignment.delete"
+	auditDeleteCourse     = "course.delete"
+	auditVerifyPayment    = "payment.verify"
+	auditAddPoints        = "points.add"
+	auditDeductPoints     = "points.deduct"
+	auditResetPassword    = "password.reset"
+	auditForcePassword    = "password.force_reset"
+	auditSetRole          = "user.role"
+	auditDeactivateUser   = "user.deactivate"
+	auditReactivateUser   = "user.reactivate"
+	auditDeleteUser       = "user.delete"
+	auditVerifyUser       = "user.verify"
+	auditRequire2FA       = "two_factor.require"
+	auditReset2FA         = "two_factor.reset"
+	auditRevokeSessions   = "sessions.revoke"
+	auditImportRoster     = "roster.import"
+)
+
+// Audit target types.
+const (
+	auditTargetCourse     = "course"
+	auditTargetAssignment = "assignment"
+	auditTargetUser       = "user"
+	auditTargetRoster     = "roster"
+)
+
+// auditExportLimit caps how many events one CSV export returns.
+const auditExportLimit = 50000
+
+var auditCollection *mongo.Collection
+
+// initAudit creates the audit_events indexes.
+func initAudit(ctx context.Context) error {
+	_, err := auditCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "at", Value: -1}}},
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "at", Value: -1}}},
+		{Keys: bson.D{{Key: "target_type", Value: 1}, {Key: "target", Value: 1}, {Key: "at", Value: -1}}},
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "at", Value: -1}}},
+	})
+	return err
+}
+
+// auditEventFor completes an event with who made the request and from
+// where. The actor defaults to the authenticated user.
+func auditEventFor(c *gin.Context, event AuditEvent) AuditEvent {
+	event.ID = primitive.NewObjectID()
+	event.At = time.Now()
+	if event.Actor == "" {
+		event.Actor = c.GetString("email")
+	}
+	event.APITokenID = c.GetString("api_token_id")
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	return event
+}
+
+// recordAudit appends an event for the request, see auditEventFor. The
+// change it describes has already happened, so a failure is logged rather
+// than reported to the client.
+func recordAudit(ctx context.Context, c *gin.Context, event AuditEvent) {
+	event = auditEventFor(c, event)
+	if _, err := auditCollection.InsertOne(ctx, event); err != nil {
+		requestLog(c).Error("Failed to record audit event", "action", event.Action, "target_type", event.TargetType, "target", event.Target, "actor", event.Actor, "error", err)
+	}
+}
+
+// auditFilter builds the query shared by GetAuditEvents and
+// ExportAuditEvents from ?actor=, ?action=, ?target_type=, ?target=,
+// ?course=, ?from= and ?to= (RFC 3339 times). It writes the error response
+// itself when a parameter is invalid.
+func auditFilter(c *gin.Context) (bson.M, bool) {
+	filter := bson.M{}
+	for _, field := range []string{"actor", "action", "target_type", "target", "course"} {
+		if value := c.Query(field); value != "" {
+			filter[field] = value
+		}
+	}
+	if actor, ok := filter["actor"].(string); ok {
+		if email, valid := normalizeEmail(actor); valid {
+			filter["actor"] = email
+		}
+	}
+	at := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+		raw := c.Query(param)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC 3339 time"})
+			return nil, false
+		}
+		at[op] = t
+	}
+	if len(at) > 0 {
+		filter["at"] = at
+	}
+	return filter, true
+}
+
+// GetAuditEvents returns a page of audit events, newest first, filtered as
+// described in auditFilter. Pages are chosen with ?page= (from 1) and
+// ?limit=.
+func GetAuditEvents(c *gin.Context) {
+	filter, ok := auditFilter(c)
+	if !ok {
+		return
+	}
+	page, limit := int64(1), int64(50)
+	if raw := c.Query("page"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "page must be a positive number"})
+			return
+		}
+		page = n
+	}
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 || n > 200 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	total, err := auditCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count audit events"})
+		return
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "at", Value: -1}}).
+		SetSkip((page - 1) * limit).
+		SetLimit(limit)
+	cursor, err := auditCollection.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit events"})
+		return
+	}
+	events := []AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse audit events"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events, "total": total, "page": page, "limit": limit})
+}
+
+// ExportAuditEvents streams the matching audit events as CSV, newest first.
+// It takes the same filters as GetAuditEvents; before and after values are
+// written as JSON.
+func ExportAuditEvents(c *gin.Context) {
+	filter, ok := auditFilter(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "at", Value: -1}}).
+		SetLimit(auditExportLimit)
+	cursor, err := auditCollection.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit events"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	filename := fmt.Sprintf("audit-events-%s.csv", time.Now().UTC().Format("20060102-150405"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write(auditCSVHeader)
+	for cursor.Next(ctx) {
+		var event AuditEvent
+		if err := cursor.Decode(&event); err != nil {
+			requestLog(c).Warn("Audit export skipping undecodable event", "error", err)
+			continue
+		}
+		w.Write(auditCSVRow(event))
+	}
+	w.Flush()
+	if err := cursor.Err(); err != nil {
+		// Headers are gone already; all we can do is cut the file short
+		requestLog(c).Error("Audit export interrupted", "error", err)
+	}
+}
+
+// auditCSVHeader names the columns of an audit export.
+var auditCSVHeader = []string{"at", "actor", "api_token_id", "action", "target_type", "target", "course", "before", "after", "ip", "user_agent"}
+
+// auditCSVRow formats an event as a row under auditCSVHeader.
+func auditCSVRow(event AuditEvent) []string {
+	row := []string{
+		event.At.UTC().Format(time.RFC3339),
+		event.Actor,
+		event.APITokenID,
+		event.Action,
+		event.TargetType,
+		event.Target,
+		event.Course,
+		auditJSON(event.Before),
+		auditJSON(event.After),
+		event.IP,
+		event.UserAgent,
+	}
+	for i, cell := range row {
+		row[i] = csvSafe(cell)
+	}
+	return row
+}
+
+func auditJSON(values bson.M) string {
+	if len(values) == 0 {
+		return ""
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// csvSafe keeps spreadsheets from running a cell as a formula. Targets and
+// user agents come from clients, so they cannot be trusted to be plain text.
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
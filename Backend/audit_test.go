@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// auditTestContext returns a context for a request to target, and the
+// recorder holding what the handler wrote.
+func auditTestContext(target string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+	return c, w
+}
+
+func TestAuditFilter(t *testing.T) {
+	from := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 4, 1, 0, 0, 0, 0, time.FixedZone("", 2*60*60))
+	tests := []struct {
+		name  string
+		query string
+		want  bson.M
+	}{
+		{"no filters", "", bson.M{}},
+		{
+			"fields",
+			"?action=points.add&target_type=user&target=student1&course=Go",
+			bson.M{"action": "points.add", "target_type": "user", "target": "student1", "course": "Go"},
+		},
+		{"actor email is normalized", "?actor=%20Admin@Example.COM", bson.M{"actor": "admin@example.com"}},
+		// Not an email, so matched as given rather than refused
+		{"actor that is not an email", "?actor=system", bson.M{"actor": "system"}},
+		{"from", "?from=2025-03-01T00:00:00Z", bson.M{"at": bson.M{"$gte": from}}},
+		{"from and to", "?from=2025-03-01T00:00:00Z&to=2025-04-01T00:00:00%2B02:00", bson.M{"at": bson.M{"$gte": from, "$lt": to}}},
+		{"unknown parameters are ignored", "?ip=203.0.113.7&page=2", bson.M{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, w := auditTestContext("/admin/audit-events" + tt.query)
+			filter, ok := auditFilter(c)
+			if !ok {
+				t.Fatalf("auditFilter() refused the query: %s", w.Body.String())
+			}
+			if !reflect.DeepEqual(filter, tt.want) {
+				t.Errorf("auditFilter() = %v, want %v", filter, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditFilterInvalidTime(t *testing.T) {
+	for _, query := range []string{"?from=yesterday", "?to=2025-03-01", "?from=2025-03-01T00:00:00Z&to=1741000000"} {
+		c, w := auditTestContext("/admin/audit-events" + query)
+		if _, ok := auditFilter(c); ok {
+			t.Errorf("auditFilter(%s) accepted", query)
+			continue
+		}
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("auditFilter(%s) wrote %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAuditEventFor(t *testing.T) {
+	c, _ := auditTestContext("/admin/leaderboard/addpoint/student1")
+	c.Request.Header.Set("User-Agent", "grading-script/1.0")
+	c.Request.RemoteAddr = "203.0.113.7:51234"
+	c.Set("email", "ta@example.com")
+	c.Set("api_token_id", "token-1")
+
+	event := auditEventFor(c, AuditEvent{Action: auditAddPoints, TargetType: auditTargetUser, Target: "student1"})
+	if event.ID.IsZero() || event.At.IsZero() {
+		t.Error("event has no ID or time")
+	}
+	if event.Actor != "ta@example.com" || event.APITokenID != "token-1" {
+		t.Errorf("actor, token = %q, %q", event.Actor, event.APITokenID)
+	}
+	if event.IP != "203.0.113.7" || event.UserAgent != "grading-script/1.0" {
+		t.Errorf("ip, user agent = %q, %q", event.IP, event.UserAgent)
+	}
+
+	// An explicit actor, as for password resets by the account's owner,
+	// is kept
+	event = auditEventFor(c, AuditEvent{Action: auditResetPassword, Actor: "student@example.com"})
+	if event.Actor != "student@example.com" {
+		t.Errorf("actor = %q, want the one given", event.Actor)
+	}
+}
+
+func TestAuditCSVRow(t *testing.T) {
+	event := AuditEvent{
+		At:         time.Date(2025, 3, 1, 13, 30, 0, 0, time.FixedZone("", 60*60)),
+		Actor:      "ta@example.com",
+		Action:     auditAddPoints,
+		TargetType: auditTargetUser,
+		Target:     "=HYPERLINK(\"http://evil.example\")",
+		Before:     bson.M{"points": 10},
+		After:      bson.M{"points": 20},
+		IP:         "203.0.113.7",
+		UserAgent:  "-script",
+	}
+	want := []string{
+		"2025-03-01T12:30:00Z",
+		"ta@example.com",
+		"",
+		"points.add",
+		"user",
+		"'=HYPERLINK(\"http://evil.example\")",
+		"",
+		`{"points":10}`,
+		`{"points":20}`,
+		"203.0.113.7",
+		"'-script",
+	}
+	row := auditCSVRow(event)
+	if len(row) != len(auditCSVHeader) {
+		t.Fatalf("row has %d cells for %d columns", len(row), len(auditCSVHeader))
+	}
+	if !reflect.DeepEqual(row, want) {
+		t.Errorf("auditCSVRow() = %q, want %q", row, want)
+	}
+}
+
+func TestCSVSafe(t *testing.T) {
+	tests := []struct {
+		cell string
+		want string
+	}{
+		{"", ""},
+		{"student1", "student1"},
+		{"=1+1", "'=1+1"},
+		{"+1", "'+1"},
+		{"-1", "'-1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\tcmd", "'\tcmd"},
+		{"\rcmd", "'\rcmd"},
+		{"a=1", "a=1"},
+	}
+	for _, tt := range tests {
+		if got := csvSafe(tt.cell); got != tt.want {
+			t.Errorf("csvSafe(%q) = %q, want %q", tt.cell, got, tt.want)
+		}
+	}
+}
+
+func TestAuditJSON(t *testing.T) {
+	if got := auditJSON(nil); got != "" {
+		t.Errorf("auditJSON(nil) = %q", got)
+	}
+	if got := auditJSON(bson.M{"role": "ta"}); got != `{"role":"ta"}` {
+		t.Errorf("auditJSON() = %q", got)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the deployment settings that differ between environments.
+// LoadConfig starts from the defaults below, applies the file named by
+// CONFIG_FILE (YAML or TOML, chosen by extension) and then these variables,
+// which win over the file:
+//
+//	MONGO_URI       MongoDB connection string
+//	MONGO_DATABASE  database holding every collection
+//	LISTEN_ADDR     address the HTTP server listens on, e.g. ":8000"
+//	CORS_ORIGINS    comma separated origins allowed to call the API
+//	UPLOADS_DIR     directory for uploaded files; course material is served at /uploads/courses
+//	LOG_FORMAT      "text" for development or "json" for log collectors
+//	LOG_LEVEL       debug, info, warn or error
+type Config struct {
+	MongoURI    string   `yaml:"mongo_uri" toml:"mongo_uri"`
+	Database    string   `yaml:"database" toml:"database"`
+	ListenAddr  string   `yaml:"listen_addr" toml:"listen_addr"`
+	CORSOrigins []string `yaml:"cors_origins" toml:"cors_origins"`
+	UploadsDir  string   `yaml:"uploads_dir" toml:"uploads_dir"`
+	LogFormat   string   `yaml:"log_format" toml:"log_format"`
+	LogLevel    string   `yaml:"log_level" toml:"log_level"`
+}
+
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		MongoURI:    "mongodb://localhost:27017",
+		Database:    "User2",
+		ListenAddr:  ":8000",
+		CORSOrigins: []string{"http://localhost:3000", "http://localhost:5173"},
+		UploadsDir:  "uploads",
+		LogFormat:   "text",
+		LogLevel:    "info",
+	}
+}
+
+// LoadConfig reads the configuration file and environment and validates the
+// result.
+func LoadConfig() (*Config, error) {
+	cfg := defaultConfig()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, fmt.Errorf("invalid CONFIG_FILE: %v", err)
+		}
+	}
+	for name, field := range map[string]*string{
+		"MONGO_URI":      &cfg.MongoURI,
+		"MONGO_DATABASE": &cfg.Database,
+		"LISTEN_ADDR":    &cfg.ListenAddr,
+		"UPLOADS_DIR":    &cfg.UploadsDir,
+		"LOG_FORMAT":     &cfg.LogFormat,
+		"LOG_LEVEL":      &cfg.LogLevel,
+	} {
+		if raw := os.Getenv(name); raw != "" {
+			*field = strings.TrimSpace(raw)
+		}
+	}
+	if raw := os.Getenv("CORS_ORIGINS"); raw != "" {
+		cfg.CORSOrigins = nil
+		for _, origin := range strings.Split(raw, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				cfg.CORSOrigins = append(cfg.CORSOrigins, origin)
+			}
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile overlays the settings in a YAML or TOML file. Keys the file
+// leaves out keep their current value; unknown keys are an error, so a typo
+// does not silently fall back to a default.
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+			return err
+		}
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			var strict *toml.StrictMissingError
+			if errors.As(err, &strict) {
+				return errors.New(strict.String())
+			}
+			return err
+		}
+	default:
+		return fmt.Errorf("%s must end in .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	// Only the shape is checked here; the driver parses the rest on connect
+	scheme, _, _ := strings.Cut(cfg.MongoURI, "://")
+	if (scheme != "mongodb" && scheme != "mongodb+srv") || mongoHost(cfg.MongoURI) == scheme+"://" {
+		// The URI may carry a password, so it is not repeated here
+		return errors.New("invalid MONGO_URI: must be a mongodb:// or mongodb+srv:// URI")
+	}
+	if cfg.Database == "" || len(cfg.Database) > 63 || strings.ContainsAny(cfg.Database, "/\\. \"$*<>:|?") {
+		return fmt.Errorf("invalid MONGO_DATABASE %q", cfg.Database)
+	}
+
+	// A bare port is accepted for convenience
+	if _, err := strconv.Atoi(cfg.ListenAddr); err == nil {
+		cfg.ListenAddr = ":" + cfg.ListenAddr
+	}
+	_, port, err := net.SplitHostPort(cfg.ListenAddr)
+	if n, perr := strconv.Atoi(port); err != nil || perr != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid LISTEN_ADDR %q", cfg.ListenAddr)
+	}
+
+	if len(cfg.CORSOrigins) == 0 {
+		return errors.New("invalid CORS_ORIGINS: at least one origin is required")
+	}
+	for i, origin := range cfg.CORSOrigins {
+		// Credentials are allowed, which browsers refuse with a wildcard
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+			return fmt.Errorf("invalid CORS_ORIGINS entry %q", origin)
+		}
+		cfg.CORSOrigins[i] = u.Scheme + "://" + u.Host
+	}
+
+	if cfg.UploadsDir == "" {
+		return errors.New("invalid UPLOADS_DIR: must not be empty")
+	}
+	cfg.UploadsDir = filepath.Clean(cfg.UploadsDir)
+
+	cfg.LogFormat = strings.ToLower(cfg.LogFormat)
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		return fmt.Errorf("invalid LOG_FORMAT %q, expected text or json", cfg.LogFormat)
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	return nil
+}
+
+// uploadPath joins elem onto the uploads directory.
+func uploadPath(elem ...string) string {
+	return filepath.Join(append([]string{config.UploadsDir}, elem...)...)
+}
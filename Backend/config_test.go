@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr string // fragment of the error, empty if valid
+		check   func(*testing.T, *Config)
+	}{
+		{name: "defaults", modify: func(*Config) {}},
+		{name: "srv URI", modify: func(c *Config) { c.MongoURI = "mongodb+srv://user:pw@cluster0.example.net/db" }},
+		{name: "replica set URI", modify: func(c *Config) { c.MongoURI = "mongodb://a:27017,b:27017/?replicaSet=rs0" }},
+		{name: "wrong scheme", modify: func(c *Config) { c.MongoURI = "postgres://localhost" }, wantErr: "invalid MONGO_URI"},
+		{name: "no host", modify: func(c *Config) { c.MongoURI = "mongodb://" }, wantErr: "invalid MONGO_URI"},
+		{name: "empty database", modify: func(c *Config) { c.Database = "" }, wantErr: "invalid MONGO_DATABASE"},
+		{name: "database with dot", modify: func(c *Config) { c.Database = "a.b" }, wantErr: "invalid MONGO_DATABASE"},
+		{name: "database too long", modify: func(c *Config) { c.Database = strings.Repeat("d", 64) }, wantErr: "invalid MONGO_DATABASE"},
+		{
+			name:   "bare port",
+			modify: func(c *Config) { c.ListenAddr = "9000" },
+			check: func(t *testing.T, c *Config) {
+				if c.ListenAddr != ":9000" {
+					t.Errorf("ListenAddr = %q, want :9000", c.ListenAddr)
+				}
+			},
+		},
+		{name: "host and port", modify: func(c *Config) { c.ListenAddr = "127.0.0.1:8080" }},
+		{name: "port out of range", modify: func(c *Config) { c.ListenAddr = ":70000" }, wantErr: "invalid LISTEN_ADDR"},
+		{name: "no port", modify: func(c *Config) { c.ListenAddr = "localhost" }, wantErr: "invalid LISTEN_ADDR"},
+		{name: "no CORS origins", modify: func(c *Config) { c.CORSOrigins = nil }, wantErr: "invalid CORS_ORIGINS"},
+		{name: "wildcard origin", modify: func(c *Config) { c.CORSOrigins = []string{"*"} }, wantErr: "invalid CORS_ORIGINS"},
+		{name: "origin with path", modify: func(c *Config) { c.CORSOrigins = []string{"https://lms.example.com/app"} }, wantErr: "invalid CORS_ORIGINS"},
+		{
+			name:   "origin normalized",
+			modify: func(c *Config) { c.CORSOrigins = []string{"https://lms.example.com/"} },
+			check: func(t *testing.T, c *Config) {
+				if want := []string{"https://lms.example.com"}; !reflect.DeepEqual(c.CORSOrigins, want) {
+					t.Errorf("CORSOrigins = %q, want %q", c.CORSOrigins, want)
+				}
+			},
+		},
+		{name: "empty uploads dir", modify: func(c *Config) { c.UploadsDir = "" }, wantErr: "invalid UPLOADS_DIR"},
+		{
+			name:   "uploads dir cleaned",
+			modify: func(c *Config) { c.UploadsDir = "data//uploads/" },
+			check: func(t *testing.T, c *Config) {
+				if want := filepath.Join("data", "uploads"); c.UploadsDir != want {
+					t.Errorf("UploadsDir = %q, want %q", c.UploadsDir, want)
+				}
+			},
+		},
+		{
+			name:   "log format case",
+			modify: func(c *Config) { c.LogFormat = "JSON" },
+			check: func(t *testing.T, c *Config) {
+				if c.LogFormat != "json" {
+					t.Errorf("LogFormat = %q, want json", c.LogFormat)
+				}
+			},
+		},
+		{name: "unknown log format", modify: func(c *Config) { c.LogFormat = "xml" }, wantErr: "invalid LOG_FORMAT"},
+		{name: "unknown log level", modify: func(c *Config) { c.LogLevel = "verbose" }, wantErr: "invalid LOG_LEVEL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			tt.modify(cfg)
+			err := cfg.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() = %v, want nil", err)
+				}
+				if tt.check != nil {
+					tt.check(t, cfg)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// clearConfigEnv unsets every variable LoadConfig reads for the test.
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"CONFIG_FILE", "MONGO_URI", "MONGO_DATABASE", "LISTEN_ADDR", "CORS_ORIGINS", "UPLOADS_DIR", "LOG_FORMAT", "LOG_LEVEL"} {
+		t.Setenv(name, "")
+	}
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "lms.yaml", `
+database: fromfile
+listen_addr: ":9001"
+cors_origins: ["https://file.example.com"]
+`))
+	t.Setenv("LISTEN_ADDR", "9002")
+	t.Setenv("CORS_ORIGINS", " https://a.example.com , ,https://b.example.com")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database != "fromfile" {
+		t.Errorf("Database = %q, want the file's value", cfg.Database)
+	}
+	if cfg.ListenAddr != ":9002" {
+		t.Errorf("ListenAddr = %q, want the environment's value", cfg.ListenAddr)
+	}
+	if want := []string{"https://a.example.com", "https://b.example.com"}; !reflect.DeepEqual(cfg.CORSOrigins, want) {
+		t.Errorf("CORSOrigins = %q, want %q", cfg.CORSOrigins, want)
+	}
+	if cfg.MongoURI != defaultConfig().MongoURI {
+		t.Errorf("MongoURI = %q, want the default", cfg.MongoURI)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr bool
+	}{
+		{"yaml", "lms.yaml", "database: lms\n", false},
+		{"yml", "lms.yml", "database: lms\n", false},
+		{"toml", "lms.toml", "database = \"lms\"\n", false},
+		{"empty yaml", "lms.yaml", "", false},
+		{"unknown yaml key", "lms.yaml", "databse: lms\n", true},
+		{"unknown toml key", "lms.toml", "databse = \"lms\"\n", true},
+		{"unsupported extension", "lms.json", "{}", true},
+		{"invalid value", "lms.yaml", "log_format: xml\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			t.Setenv("CONFIG_FILE", writeConfigFile(t, tt.file, tt.content))
+			cfg, err := LoadConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("LoadConfig() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() = %v", err)
+			}
+			if tt.content != "" && cfg.Database != "lms" {
+				t.Errorf("Database = %q, want lms", cfg.Database)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EmailJob is an email waiting in the outbound queue, or the record of one
+// that was delivered or given up on. Handlers enqueue jobs and return right
+// away; background workers do the actual sending.
+type EmailJob struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	To       []string           `json:"to" bson:"to"`
+	Template string             `json:"template" bson:"template"`
+	Subject  string             `json:"subject" bson:"subject"`
+	// The rendered body, removed once it is no longer needed, see
+	// emailBodyDone
+	Text          string     `json:"-" bson:"text,omitempty"`
+	HTML          string     `json:"-" bson:"html,omitempty"`
+	Status        string     `json:"status" bson:"status"`
+	Attempts      int        `json:"attempts" bson:"attempts"`
+	LastError     string     `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" bson:"next_attempt_at"`
+	LockedUntil   time.Time  `json:"-" bson:"locked_until"`
+	CreatedAt     time.Time  `json:"created_at" bson:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" bson:"updated_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty" bson:"sent_at,omitempty"`
+}
+
+// Email job states. A job moves from pending to sending when a worker claims
+// it, then to sent, back to pending for a retry, or to dead once it has
+// failed emailMaxAttempts times.
+const (
+	emailStatusPending = "pending"
+	emailStatusSending = "sending"
+	emailStatusSent    = "sent"
+	emailStatusDead    = "dead"
+)
+
+var emailJobCollection *mongo.Collection
+
+// Queue settings, overridable through EMAIL_WORKERS, EMAIL_MAX_ATTEMPTS and
+// EMAIL_RETRY_BASE.
+var (
+	emailWorkers     = 2
+	emailMaxAttempts = 5
+	emailRetryBase   = 30 * time.Second
+)
+
+const (
+	emailRetryMax     = time.Hour
+	emailSendLease    = 2 * time.Minute
+	emailPollInterval = 2 * time.Second
+	// emailJobRetention is how long the delivery record of an email is kept.
+	emailJobRetention = 30 * 24 * time.Hour
+)
+
+// emailSecretTemplates are the emails whose body carries a code or a
+// set-password link. Their body is dropped as soon as the job is finished,
+// including when it is dead-lettered, so the database never holds a usable
+// code for longer than delivery takes, and a dead job cannot be retried
+// hours later with a stale code.
+var emailSecretTemplates = map[string]bool{
+	emailOTP:           true,
+	emailPasswordReset: true,
+	emailVerifyEmail:   true,
+	emailAccountLocked: true,
+	emailInvitation:    true,
+}
+
+// emailBodyDone reports whether a job in status no longer needs its body.
+// Sent jobs never do; dead ones keep it for RetryEmailDelivery unless it
+// holds a secret.
+func emailBodyDone(template, status string) bool {
+	return status == emailStatusSent || (status == emailStatusDead && emailSecretTemplates[template])
+}
+
+// initEmailQueue reads the queue settings and creates the email_jobs indexes.
+func initEmailQueue(ctx context.Context) error {
+	if raw := os.Getenv("EMAIL_WORKERS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid EMAIL_WORKERS %q", raw)
+		}
+		emailWorkers = n
+	}
+	if raw := os.Getenv("EMAIL_MAX_ATTEMPTS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid EMAIL_MAX_ATTEMPTS %q", raw)
+		}
+		emailMaxAttempts = n
+	}
+	if raw := os.Getenv("EMAIL_RETRY_BASE"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid EMAIL_RETRY_BASE %q", raw)
+		}
+		emailRetryBase = d
+	}
+	_, err := emailJobCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{Keys: bson.D{{Key: "to", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "created_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(emailJobRetention.Seconds()))},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Jobs finished before bodies were dropped still hold theirs
+	secret := make(bson.A, 0, len(emailSecretTemplates))
+	for name := range emailSecretTemplates {
+		secret = append(secret, name)
+	}
+	_, err = emailJobCollection.UpdateMany(ctx,
+		bson.M{
+			"$or": bson.A{
+				bson.M{"status": emailStatusSent},
+				bson.M{"status": emailStatusDead, "template": bson.M{"$in": secret}},
+			},
+			"text": bson.M{"$exists": true},
+		},
+		bson.M{"$unset": bson.M{"text": "", "html": ""}})
+	return err
+}
+
+// enqueueEmail renders a template and queues the resulting mail.
+func enqueueEmail(ctx context.Context, template string, data any, to ...string) error {
+	message, err := renderEmail(template, data, to...)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err = emailJobCollection.InsertOne(ctx, EmailJob{
+		ID:            primitive.NewObjectID(),
+		To:            message.To,
+		Template:      template,
+		Subject:       message.Subject,
+		Text:          message.Text,
+		HTML:          message.HTML,
+		Status:        emailStatusPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	})
+	return err
+}
+
+// emailRetryDelay is the exponential backoff before retry number attempts.
+func emailRetryDelay(attempts int) time.Duration {
+	delay := emailRetryBase
+	for i := 1; i < attempts && delay < emailRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > emailRetryMax {
+		delay = emailRetryMax
+	}
+	return delay
+}
+
+// startEmailWorkers runs the queue workers until ctx is cancelled. The
+// returned group is done once every worker has returned.
+func startEmailWorkers(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for i := 0; i < emailWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runEmailWorker(ctx)
+		}()
+	}
+	return &wg
+}
+
+func runEmailWorker(ctx context.Context) {
+	for {
+		job, err := claimEmailJob(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Email queue failed to claim job", "error", err)
+		}
+		if job != nil {
+			deliverEmailJob(ctx, job)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(emailPollInterval):
+		}
+	}
+}
+
+// claimEmailJob atomically takes the next due job. Jobs whose worker died
+// mid-send become claimable again once their lease runs out, so several
+// replicas can share the queue.
+func claimEmailJob(ctx context.Context) (*EmailJob, error) {
+	now := time.Now()
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": emailStatusPending, "next_attempt_at": bson.M{"$lte": now}},
+		bson.M{"status": emailStatusSending, "locked_until": bson.M{"$lt": now}},
+	}}
+	update := bson.M{"$set": bson.M{
+		"status":       emailStatusSending,
+		"locked_until": now.Add(emailSendLease),
+		"updated_at":   now,
+	}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+		SetReturnDocument(options.After)
+	var job EmailJob
+	err := emailJobCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// deliverEmailJob sends a claimed job and records the outcome.
+func deliverEmailJob(ctx context.Context, job *EmailJob) {
+	sendCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	err := mailer.Send(sendCtx, &Mail{To: job.To, Subject: job.Subject, Text: job.Text, HTML: job.HTML})
+	cancel()
+	if otpTemplates[job.Template] {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		otpEmails.WithLabelValues(job.Template, result).Inc()
+	}
+
+	now := time.Now()
+	set := bson.M{"updated_at": now}
+	if err == nil {
+		set["status"] = emailStatusSent
+		set["sent_at"] = now
+	} else {
+		attempts := job.Attempts + 1
+		set["attempts"] = attempts
+		set["last_error"] = err.Error()
+		if attempts >= emailMaxAttempts {
+			set["status"] = emailStatusDead
+			slog.Error("Email queue giving up on job", "job_id", job.ID.Hex(), "to", job.To, "attempts", attempts, "error", err)
+		} else {
+			set["status"] = emailStatusPending
+			set["next_attempt_at"] = now.Add(emailRetryDelay(attempts))
+		}
+	}
+	update := bson.M{"$set": set}
+	if emailBodyDone(job.Template, set["status"].(string)) {
+		update["$unset"] = bson.M{"text": "", "html": ""}
+	}
+	// Record the result even if shutdown has started
+	updateCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Only while we still hold the lease: once it ran out another worker may
+	// have claimed the job, and its result wins
+	filter := bson.M{"_id": job.ID, "status": emailStatusSending, "locked_until": job.LockedUntil}
+	result, err := emailJobCollection.UpdateOne(updateCtx, filter, update)
+	if err != nil {
+		slog.Error("Email queue failed to update job", "job_id", job.ID.Hex(), "error", err)
+		return
+	}
+	if result.MatchedCount == 0 {
+		slog.Warn("Email queue lost the lease on job before recording its result", "job_id", job.ID.Hex(), "status", set["status"])
+	}
+}
+
+// GetEmailDeliveries lists queued and sent emails, newest first, optionally
+// filtered by ?recipient= and ?status=.
+func GetEmailDeliveries(c *gin.Context) {
+	filter := bson.M{}
+	if recipient := c.Query("recipient"); recipient != "" {
+		filter["to"] = recipient
+	}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+	limit := int64(100)
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 || n > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit)
+	cursor, err := emailJobCollection.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deliveries"})
+		return
+	}
+	jobs := []EmailJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse deliveries"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": jobs})
+}
+
+// RetryEmailDelivery puts a dead-lettered email back in the queue. Emails
+// that carried a code or link cannot be retried, since their body is gone;
+// the user has to ask for a new one.
+func RetryEmailDelivery(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	result, err := emailJobCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "status": emailStatusDead, "text": bson.M{"$exists": true}},
+		bson.M{"$set": bson.M{
+			"status":          emailStatusPending,
+			"attempts":        0,
+			"next_attempt_at": now,
+			"updated_at":      now,
+		}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue delivery"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		count, err := emailJobCollection.CountDocuments(ctx, bson.M{"_id": id, "status": emailStatusDead})
+		if err == nil && count > 0 {
+			c.JSON(http.StatusGone, gin.H{"error": "This email carried a code or link and was discarded; the user has to request a new one"})
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "No dead-lettered delivery with this ID"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Delivery requeued"})
+}
+
+// SendAnnouncement queues an announcement email to every user, or to every
+// user with the given role.
+func SendAnnouncement(c *gin.Context) {
+	var input struct {
+		Subject string `json:"subject"`
+		Message string `json:"message"`
+		Role    string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Subject == "" || input.Message == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subject and message are required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	filter := bson.M{}
+	if input.Role != "" {
+		filter["role"] = input.Role
+	}
+	cursor, err := userCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"email": 1, "username": 1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+	var users []User
+	if err := cursor.All(ctx, &users); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse users"})
+		return
+	}
+
+	queued := 0
+	for _, user := range users {
+		err := enqueueEmail(ctx, emailAnnouncement, gin.H{
+			"Username": user.Username,
+			"Subject":  input.Subject,
+			"Message":  input.Message,
+		}, user.Email)
+		if err != nil {
+			requestLog(c).Error("Announcement not queued", "email", user.Email, "error", err)
+			continue
+		}
+		queued++
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Announcement queued", "queued": queued, "recipients": len(users)})
+}
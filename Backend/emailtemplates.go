@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Email templates live in templates/email. Each email has a NAME.txt file
+// defining the "subject" and "text" templates and a NAME.html file with the
+// HTML body; both are rendered with the same data.
+//
+//go:embed templates/email
+var emailTemplateFS embed.FS
+
+const (
+	emailOTP           = "otp"
+	emailPasswordReset = "password_reset"
+	emailGradeReleased = "grade_released"
+	emailQuizReminder  = "quiz_reminder"
+	emailAnnouncement  = "announcement"
+	emailVerifyEmail   = "verify_email"
+	emailAccountLocked = "account_locked"
+	emailInvitation    = "invitation"
+)
+
+var (
+	emailTextTemplates = map[string]*texttemplate.Template{}
+	emailHTMLTemplates = map[string]*htmltemplate.Template{}
+)
+
+// loadEmailTemplates parses every known email template so that a broken
+// template stops the server at startup instead of failing a send.
+func loadEmailTemplates() error {
+	for _, name := range []string{emailOTP, emailPasswordReset, emailGradeReleased, emailQuizReminder, emailAnnouncement, emailVerifyEmail, emailAccountLocked, emailInvitation} {
+		text, err := texttemplate.ParseFS(emailTemplateFS, "templates/email/"+name+".txt")
+		if err != nil {
+			return err
+		}
+		if text.Lookup("subject") == nil || text.Lookup("text") == nil {
+			return fmt.Errorf("email template %s.txt must define subject and text", name)
+		}
+		html, err := htmltemplate.ParseFS(emailTemplateFS, "templates/email/"+name+".html")
+		if err != nil {
+			return err
+		}
+		emailTextTemplates[name] = text
+		emailHTMLTemplates[name] = html
+	}
+	return nil
+}
+
+// renderEmail builds the mail for a template addressed to the recipients.
+func renderEmail(name string, data any, to ...string) (*Mail, error) {
+	text, ok := emailTextTemplates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown email template %q", name)
+	}
+	var subject, body, html bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := text.ExecuteTemplate(&body, "text", data); err != nil {
+		return nil, err
+	}
+	if err := emailHTMLTemplates[name].Execute(&html, data); err != nil {
+		return nil, err
+	}
+	return &Mail{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    body.String(),
+		HTML:    html.String(),
+	}, nil
+}
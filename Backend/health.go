@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Build information, set at link time:
+//
+//	go build -ldflags "-X main.buildCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When they are left empty the VCS stamp the Go toolchain embeds is used.
+var (
+	buildCommit string
+	buildTime   string
+)
+
+// probePaths are the unauthenticated probe endpoints, kept out of the
+// request log since orchestrators call them every few seconds.
+var probePaths = []string{"/healthz", "/readyz", "/version"}
+
+var mongoClient *mongo.Client
+
+// Healthz reports that the process is up and serving requests.
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz reports whether this instance can handle traffic: MongoDB answers,
+// the uploads directory is writable and a mailer is configured. Failures
+// are described only briefly, since anyone can call it.
+func Readyz(c *gin.Context) {
+	checks := gin.H{"mongo": "ok", "uploads": "ok", "mailer": "ok"}
+	ready := true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if mongoClient == nil || mongoClient.Ping(ctx, nil) != nil {
+		checks["mongo"] = "unreachable"
+		ready = false
+	}
+	if f, err := os.CreateTemp(config.UploadsDir, ".readyz-*"); err != nil {
+		checks["uploads"] = "not writable"
+		ready = false
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if mailer == nil {
+		checks["mailer"] = "not configured"
+		ready = false
+	}
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "checks": checks})
+}
+
+// Version describes the running build and the settings it was started
+// with. Credentials, signing keys and other secrets are left out.
+func Version(c *gin.Context) {
+	commit, built := buildCommit, buildTime
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && built == "":
+				built = setting.Value
+			}
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if built == "" {
+		built = "unknown"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"commit":    commit,
+		"buildTime": built,
+		"goVersion": runtime.Version(),
+		"config": gin.H{
+			"mongoHost":   mongoHost(config.MongoURI),
+			"database":    config.Database,
+			"listenAddr":  config.ListenAddr,
+			"corsOrigins": config.CORSOrigins,
+			"uploadsDir":  config.UploadsDir,
+			"mailDriver":  mailDriver(),
+			"sso":         oidcConfig != nil,
+		},
+	})
+}
+
+// mongoHost returns the hosts of a MongoDB URI without the credentials and
+// options it may carry. url.Parse cannot be used, since a replica set URI
+// lists several hosts.
+func mongoHost(uri string) string {
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok {
+		return ""
+	}
+	hosts, _, _ := strings.Cut(rest, "/")
+	hosts, _, _ = strings.Cut(hosts, "?")
+	if i := strings.LastIndex(hosts, "@"); i >= 0 {
+		hosts = hosts[i+1:]
+	}
+	return scheme + "://" + hosts
+}
+
+func mailDriver() string {
+	switch mailer.(type) {
+	case *SMTPMailer:
+		return "smtp"
+	case *FileMailer:
+		return "file"
+	case nil:
+		return "none"
+	}
+	return "custom"
+}
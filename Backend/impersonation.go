@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ImpersonationEvent records an admin starting or stopping to act as another
+// user. Events are only ever inserted, so the log shows every impersonation
+// even after its session is gone.
+type ImpersonationEvent struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	Action    string             `json:"action" bson:"action"` // start or stop
+	Admin     string             `json:"admin" bson:"admin"`
+	Target    string             `json:"target" bson:"target"`
+	SessionID string             `json:"session_id" bson:"session_id"`
+	Reason    string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	IP        string             `json:"ip" bson:"ip"`
+	UserAgent string             `json:"user_agent" bson:"user_agent"`
+	At        time.Time          `json:"at" bson:"at"`
+	ExpiresAt *time.Time         `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+}
+
+const (
+	impersonationStart = "start"
+	impersonationStop  = "stop"
+)
+
+var impersonationEventCollection *mongo.Collection
+
+// impersonationTTL is how long an impersonation token works, overridable
+// through IMPERSONATION_TTL. It cannot be refreshed.
+var impersonationTTL = 30 * time.Minute
+
+// impersonationWrites are the only non-GET routes an impersonation token may
+// call; everything else it can do is read-only.
+var impersonationWrites = map[string]bool{
+	"POST /impersonation/stop": true,
+	"POST /logout":             true,
+	"POST /check-role":         true, // only reads, but is a POST
+}
+
+// initImpersonation reads the impersonation lifetime and creates the
+// impersonation_events indexes.
+func initImpersonation(ctx context.Context) error {
+	if raw := os.Getenv("IMPERSONATION_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid IMPERSONATION_TTL %q", raw)
+		}
+		impersonationTTL = ttl
+	}
+	_, err := impersonationEventCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "admin", Value: 1}, {Key: "at", Value: -1}}},
+		{Keys: bson.D{{Key: "target", Value: 1}, {Key: "at", Value: -1}}},
+	})
+	return err
+}
+
+// impersonationAllows reports whether an impersonation token may be used
+// for the request.
+func impersonationAllows(method, route string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return impersonationWrites[method+" "+route]
+}
+
+// recordImpersonation appends an event to the impersonation log.
+func recordImpersonation(ctx context.Context, c *gin.Context, event ImpersonationEvent) error {
+	event.ID = primitive.NewObjectID()
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	event.At = time.Now()
+	_, err := impersonationEventCollection.InsertOne(ctx, event)
+	return err
+}
+
+// StartImpersonation gives an admin a short-lived, read-only token that acts
+// as the user in :email, so they can see what the student sees without
+// asking for their password. Admin accounts cannot be impersonated. The
+// optional "reason" is kept in the log.
+func StartImpersonation(c *gin.Context) {
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+	input.Reason = strings.TrimSpace(input.Reason)
+	if len(input.Reason) > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reason must be at most 500 characters"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	switch {
+	case isSelf(c, user):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot impersonate yourself"})
+		return
+	case user.Role == roleAdmin:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admins cannot be impersonated"})
+		return
+	case user.DeactivatedAt != nil:
+		c.JSON(http.StatusConflict, gin.H{"error": "Account deactivated"})
+		return
+	}
+
+	// A session of its own, so the impersonation can be ended or revoked like
+	// any login. Without a refresh hash it cannot be refreshed.
+	admin := c.GetString("email")
+	session := newSession(c, user.Email)
+	session.ImpersonatedBy = admin
+	session.ExpiresAt = session.CreatedAt.Add(impersonationTTL)
+	expiresAt := session.ExpiresAt
+	if _, err := sessionCollection.InsertOne(ctx, session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+	err := recordImpersonation(ctx, c, ImpersonationEvent{
+		Action:    impersonationStart,
+		Admin:     admin,
+		Target:    user.Email,
+		SessionID: session.ID.Hex(),
+		Reason:    input.Reason,
+		ExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		// No impersonation without a trace of it
+		revokeSession(ctx, session.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record impersonation"})
+		return
+	}
+
+	tokenString, err := tokens.IssueImpersonation(user.Email, session.ID.Hex(), admin, expiresAt)
+	if err != nil {
+		revokeSession(ctx, session.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Impersonation started",
+		"token":         tokenString,
+		"expiresAt":     expiresAt,
+		"impersonating": summarizeUser(user),
+	})
+}
+
+// StopImpersonation ends the impersonation session the request is made with.
+func StopImpersonation(c *gin.Context) {
+	admin := c.GetString("impersonated_by")
+	if admin == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Not impersonating"})
+		return
+	}
+	sessionID, err := primitive.ObjectIDFromHex(c.GetString("session_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token data"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := revokeSession(ctx, sessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end impersonation"})
+		return
+	}
+	err = recordImpersonation(ctx, c, ImpersonationEvent{
+		Action:    impersonationStop,
+		Admin:     admin,
+		Target:    c.GetString("email"),
+		SessionID: sessionID.Hex(),
+	})
+	if err != nil {
+		requestLog(c).Error("Failed to record end of impersonation", "session_id", sessionID.Hex(), "error", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Impersonation ended"})
+}
+
+// GetImpersonationEvents lists the impersonation log, newest first.
+// Filters: ?admin= and ?target= (emails). Pages are chosen with ?page=
+// (from 1) and ?limit=.
+func GetImpersonationEvents(c *gin.Context) {
+	filter := bson.M{}
+	for _, field := range []string{"admin", "target"} {
+		if raw := c.Query(field); raw != "" {
+			email, ok := normalizeEmail(raw)
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + field + " email"})
+				return
+			}
+			filter[field] = email
+		}
+	}
+	page, limit := int64(1), int64(50)
+	if raw := c.Query("page"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "page must be a positive number"})
+			return
+		}
+		page = n
+	}
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 || n > 200 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "at", Value: -1}}).
+		SetSkip((page - 1) * limit).
+		SetLimit(limit)
+	cursor, err := impersonationEventCollection.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch impersonation log"})
+		return
+	}
+	events := []ImpersonationEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse impersonation log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events, "page": page, "limit": limit})
+}
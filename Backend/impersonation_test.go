@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestImpersonationAllows(t *testing.T) {
+	tests := []struct {
+		method string
+		route  string
+		want   bool
+	}{
+		{"GET", "/me/details", true},
+		{"GET", "/admin/users", true},
+		{"HEAD", "/me/details", true},
+		{"OPTIONS", "/submit-quiz", true},
+		{"POST", "/impersonation/stop", true},
+		{"POST", "/logout", true},
+		{"POST", "/check-role", true},
+		{"POST", "/submit-quiz", false},
+		{"POST", "/update-details", false},
+		{"POST", "/me/tokens", false},
+		{"POST", "/me/2fa/disable", false},
+		{"DELETE", "/me/sessions/:id", false},
+		{"PUT", "/admin/users/:email/role", false},
+		// Only the listed method opens a route
+		{"DELETE", "/logout", false},
+		{"PUT", "/impersonation/stop", false},
+	}
+	for _, tt := range tests {
+		if got := impersonationAllows(tt.method, tt.route); got != tt.want {
+			t.Errorf("impersonationAllows(%s %s) = %v, want %v", tt.method, tt.route, got, tt.want)
+		}
+	}
+}
+
+func TestImpersonationToken(t *testing.T) {
+	s := newTestTokenService(t, map[string]string{"JWT_SECRET": "secret", "JWT_TTL": "15m"})
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	tokenString, err := s.IssueImpersonation("student@example.com", "session-1", "admin@example.com", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.Parse(tokenString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Email != "student@example.com" || claims.SessionID != "session-1" || claims.ImpersonatedBy != "admin@example.com" {
+		t.Errorf("claims = %q, %q, %q", claims.Email, claims.SessionID, claims.ImpersonatedBy)
+	}
+	// Bound to the impersonation session, not the access token lifetime
+	if claims.ExpiresAt != expiresAt.Unix() {
+		t.Errorf("expires at %v, want %v", time.Unix(claims.ExpiresAt, 0), expiresAt)
+	}
+
+	expired, err := s.IssueImpersonation("student@example.com", "session-1", "admin@example.com", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Parse(expired); err == nil {
+		t.Error("expired impersonation token accepted")
+	}
+}
+
+func TestSessionMatchesClaims(t *testing.T) {
+	own := &Session{Email: "student@example.com"}
+	impersonated := &Session{Email: "student@example.com", ImpersonatedBy: "admin@example.com"}
+	tests := []struct {
+		name    string
+		session *Session
+		claims  Claims
+		want    bool
+	}{
+		{"own token", own, Claims{Email: "student@example.com"}, true},
+		{"impersonation token", impersonated, Claims{Email: "student@example.com", ImpersonatedBy: "admin@example.com"}, true},
+		{"another user's session", own, Claims{Email: "other@example.com"}, false},
+		{"impersonation token on the user's own session", own, Claims{Email: "student@example.com", ImpersonatedBy: "admin@example.com"}, false},
+		{"plain token on an impersonation session", impersonated, Claims{Email: "student@example.com"}, false},
+		{"another admin", impersonated, Claims{Email: "student@example.com", ImpersonatedBy: "other-admin@example.com"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sessionMatchesClaims(tt.session, &tt.claims); got != tt.want {
+				t.Errorf("sessionMatchesClaims() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImpersonationWritesAreRoutes(t *testing.T) {
+	for route := range impersonationWrites {
+		method, path, ok := strings.Cut(route, " ")
+		if !ok || method == http.MethodGet || !strings.HasPrefix(path, "/") {
+			t.Errorf("%q is not \"METHOD /route\" for a write", route)
+		}
+	}
+}
+
+func TestStopImpersonationWithoutImpersonating(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/impersonation/stop", nil)
+	c.Set("email", "student@example.com")
+	c.Set("session_id", "65f000000000000000000001")
+	// Refused before the session is revoked, so no database is needed
+	StopImpersonation(c)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("StopImpersonation() = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDHeader carries the request ID in both directions. A load
+// balancer or client may set it, so one ID follows a request across
+// services; otherwise the server generates one.
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+func parseLogLevel(raw string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(raw)); err != nil {
+		return 0, fmt.Errorf("invalid LOG_LEVEL %q, expected debug, info, warn or error", raw)
+	}
+	return level, nil
+}
+
+// setupLogging makes the configured logger the default, for slog as well
+// as for the standard log package used by libraries.
+func setupLogging(cfg *Config) {
+	level, _ := parseLogLevel(cfg.LogLevel)
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	// gin prints its own debug lines otherwise
+	gin.DefaultWriter = io.Discard
+}
+
+// requestLog returns the logger for a request, which tags every line with
+// the request ID.
+func requestLog(c *gin.Context) *slog.Logger {
+	return slog.Default().With("request_id", c.GetString("request_id"))
+}
+
+// RequestID makes sure every request has an ID, available as "request_id"
+// in the context and echoed in the X-Request-ID response header.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			var err error
+			if id, err = randomURLSafe(12); err != nil {
+				id = fmt.Sprintf("%x", time.Now().UnixNano())
+			}
+		}
+		c.Set("request_id", id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// RequestLogger writes one line per request with its route, status,
+// latency and the user who made it. Server errors are logged as errors and
+// client errors as warnings. Paths in skip are not logged at all.
+func RequestLogger(skip ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if slices.Contains(skip, c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+		// The route, not the path, so emails and names in URLs stay out of
+		// the log and lines group by endpoint
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+			slog.String("ip", c.ClientIP()),
+		}
+		if email := c.GetString("email"); email != "" {
+			attrs = append(attrs, slog.String("user", email))
+		}
+		if admin := c.GetString("impersonated_by"); admin != "" {
+			attrs = append(attrs, slog.String("impersonated_by", admin))
+		}
+		if tokenID := c.GetString("api_token_id"); tokenID != "" {
+			attrs = append(attrs, slog.String("api_token_id", tokenID))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", strings.TrimSpace(c.Errors.String())))
+		}
+		requestLog(c).LogAttrs(c.Request.Context(), level, "Request", attrs...)
+	}
+}
+
+// Recovery turns a panic in a handler into a 500 and logs it with the
+// request ID and stack.
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered any) {
+		requestLog(c).Error("Handler panicked",
+			"panic", fmt.Sprint(recovered),
+			"route", c.FullPath(),
+			"stack", string(debug.Stack()))
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	})
+}
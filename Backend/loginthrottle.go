@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LoginAttempts counts recent failed logins for one account ("email:...")
+// or one client address ("ip:..."). Counters are checked before the password
+// is hashed, so a flood of guesses costs the server a single lookup each.
+type LoginAttempts struct {
+	Key           string    `json:"key" bson:"key"`
+	Failures      int       `json:"failures" bson:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at" bson:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until,omitempty" bson:"locked_until,omitempty"`
+	ExpiresAt     time.Time `json:"-" bson:"expires_at"`
+}
+
+var loginAttemptCollection *mongo.Collection
+
+// Throttling settings, overridable through LOGIN_MAX_FAILURES,
+// LOGIN_MAX_IP_FAILURES, LOGIN_FAILURE_WINDOW and LOGIN_LOCKOUT_DURATION.
+var (
+	loginMaxFailures   = 5
+	loginMaxIPFailures = 50
+	loginFailureWindow = 15 * time.Minute
+	loginLockout       = 15 * time.Minute
+)
+
+const (
+	// Failures allowed before each further attempt has to wait, and the cap
+	// on that wait.
+	loginFreeFailures = 2
+	loginMaxDelay     = 30 * time.Second
+)
+
+// initLoginThrottle reads the throttling settings and creates the
+// login_attempts indexes. Counters disappear once they stop mattering.
+func initLoginThrottle(ctx context.Context) error {
+	if err := loadLoginThrottleSettings(); err != nil {
+		return err
+	}
+	_, err := loginAttemptCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// loadLoginThrottleSettings reads LOGIN_MAX_FAILURES, LOGIN_MAX_IP_FAILURES,
+// LOGIN_FAILURE_WINDOW and LOGIN_LOCKOUT_DURATION.
+func loadLoginThrottleSettings() error {
+	for _, setting := range []struct {
+		env   string
+		value *int
+	}{
+		{"LOGIN_MAX_FAILURES", &loginMaxFailures},
+		{"LOGIN_MAX_IP_FAILURES", &loginMaxIPFailures},
+	} {
+		if raw := os.Getenv(setting.env); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid %s %q", setting.env, raw)
+			}
+			*setting.value = n
+		}
+	}
+	for _, setting := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"LOGIN_FAILURE_WINDOW", &loginFailureWindow},
+		{"LOGIN_LOCKOUT_DURATION", &loginLockout},
+	} {
+		if raw := os.Getenv(setting.env); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s %q", setting.env, raw)
+			}
+			*setting.value = d
+		}
+	}
+	return nil
+}
+
+func loginEmailKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func loginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginDelay is how long a client must wait after its latest failure before
+// trying again: nothing for the first few failures, then doubling.
+func loginDelay(failures int) time.Duration {
+	if failures <= loginFreeFailures {
+		return 0
+	}
+	delay := time.Second * time.Duration(math.Pow(2, float64(failures-loginFreeFailures-1)))
+	if delay > loginMaxDelay || delay <= 0 {
+		delay = loginMaxDelay
+	}
+	return delay
+}
+
+// loginRetryAfter returns how long the account and the client address have
+// to wait before another login attempt, or zero if one is allowed now.
+func loginRetryAfter(ctx context.Context, email, ip string) (time.Duration, error) {
+	cursor, err := loginAttemptCollection.Find(ctx, bson.M{"key": bson.M{"$in": bson.A{loginEmailKey(email), loginIPKey(ip)}}})
+	if err != nil {
+		return 0, err
+	}
+	var counters []LoginAttempts
+	if err := cursor.All(ctx, &counters); err != nil {
+		return 0, err
+	}
+	return loginWait(counters, time.Now()), nil
+}
+
+// loginWait is how long after now the given counters allow the next login
+// attempt. Locks apply to accounts and addresses alike; the growing delay
+// between failures only to accounts.
+func loginWait(counters []LoginAttempts, now time.Time) time.Duration {
+	var wait time.Duration
+	for _, counter := range counters {
+		if counter.LastFailureAt.Before(now.Add(-loginFailureWindow)) && counter.LockedUntil.Before(now) {
+			continue
+		}
+		until := counter.LockedUntil
+		if strings.HasPrefix(counter.Key, "email:") {
+			if delayed := counter.LastFailureAt.Add(loginDelay(counter.Failures)); delayed.After(until) {
+				until = delayed
+			}
+		}
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// recordLoginFailure bumps the counter for key and locks it once it reaches
+// max failures within the window. It returns the updated counter.
+func recordLoginFailure(ctx context.Context, key string, max int) (*LoginAttempts, error) {
+	now := time.Now()
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failures": bson.M{"$cond": bson.A{
+				bson.M{"$lt": bson.A{"$last_failure_at", now.Add(-loginFailureWindow)}},
+				1,
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failures", 0}}, 1}},
+			}},
+			"last_failure_at": now,
+			"expires_at":      now.Add(loginFailureWindow + loginLockout),
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"locked_until": bson.M{"$cond": bson.A{
+				bson.M{"$gte": bson.A{"$failures", max}},
+				now.Add(loginLockout),
+				"$locked_until",
+			}},
+		}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var counter LoginAttempts
+	if err := loginAttemptCollection.FindOneAndUpdate(ctx, bson.M{"key": key}, pipeline, opts).Decode(&counter); err != nil {
+		return nil, err
+	}
+	return &counter, nil
+}
+
+// throttleLogin rejects the request with 429 if the account or client must
+// wait. It reports whether the login may proceed.
+func throttleLogin(c *gin.Context, ctx context.Context, email string) bool {
+	wait, err := loginRetryAfter(ctx, email, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+		return false
+	}
+	if wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts, please try again later", "retryAfter": seconds})
+		return false
+	}
+	return true
+}
+
+// loginFailed records a failed login for the account and the client. When
+// the account gets locked, its owner is emailed a code to unlock it.
+func loginFailed(c *gin.Context, ctx context.Context, email string) {
+	if _, err := recordLoginFailure(ctx, loginIPKey(c.ClientIP()), loginMaxIPFailures); err != nil {
+		requestLog(c).Error("Failed to record login failure", "ip", c.ClientIP(), "error", err)
+	}
+	counter, err := recordLoginFailure(ctx, loginEmailKey(email), loginMaxFailures)
+	if err != nil {
+		requestLog(c).Error("Failed to record login failure", "email", email, "error", err)
+		return
+	}
+	if counter.Failures != loginMaxFailures {
+		return
+	}
+	user, err := findUserByEmail(ctx, email)
+	if err != nil {
+		return
+	}
+	otp, err := issueOTP(ctx, user.Email, otpPurposeUnlockAccount)
+	if err != nil {
+		requestLog(c).Error("Failed to issue unlock code", "email", user.Email, "error", err)
+		return
+	}
+	err = enqueueEmail(ctx, emailAccountLocked, gin.H{
+		"Username":         user.Username,
+		"OTP":              otp,
+		"LockoutMinutes":   int(loginLockout.Minutes()),
+		"ExpiresInMinutes": int(otpTTL.Minutes()),
+	}, user.Email)
+	if err != nil {
+		requestLog(c).Error("Unlock email not queued", "email", user.Email, "error", err)
+	}
+}
+
+// loginSucceeded clears the account's failure counter.
+func loginSucceeded(ctx context.Context, email string) {
+	if _, err := loginAttemptCollection.DeleteOne(ctx, bson.M{"key": loginEmailKey(email)}); err != nil {
+		slog.Error("Failed to reset login failures", "email", email, "error", err)
+	}
+}
+
+// UnlockAccount lifts a lockout with the code emailed when it started.
+func UnlockAccount(c *gin.Context) {
+	var input struct {
+		Email string `json:"email"`
+		OTP   string `json:"otp"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := findUserByEmail(ctx, input.Email)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid OTP"})
+		return
+	}
+	if err := verifyOTP(ctx, user.Email, otpPurposeUnlockAccount, input.OTP); err != nil {
+		switch err {
+		case errOTPInvalid:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid OTP"})
+		case errOTPExpired:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "OTP expired"})
+		case errOTPTooManyAttempts:
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify OTP"})
+		}
+		return
+	}
+	loginSucceeded(ctx, user.Email)
+	c.JSON(http.StatusOK, gin.H{"message": "Account unlocked, you can log in again"})
+}
+
+// GetLoginLockouts lists accounts and addresses with recent failed logins.
+// Pass ?locked=true to only see active lockouts.
+func GetLoginLockouts(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if c.Query("locked") == "true" {
+		filter["locked_until"] = bson.M{"$gt": time.Now()}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "last_failure_at", Value: -1}}).SetLimit(500)
+	cursor, err := loginAttemptCollection.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch lockouts"})
+		return
+	}
+	counters := []LoginAttempts{}
+	if err := cursor.All(ctx, &counters); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse lockouts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"lockouts": counters})
+}
+
+// ClearLoginLockout resets the counters for ?email= and/or ?ip=.
+func ClearLoginLockout(c *gin.Context) {
+	var keys bson.A
+	if email := c.Query("email"); email != "" {
+		keys = append(keys, loginEmailKey(email))
+	}
+	if ip := c.Query("ip"); ip != "" {
+		keys = append(keys, loginIPKey(ip))
+	}
+	if len(keys) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email or ip is required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := loginAttemptCollection.DeleteMany(ctx, bson.M{"key": bson.M{"$in": keys}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear lockout"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Lockout cleared", "cleared": result.DeletedCount})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// saveLoginThrottleSettings restores the throttling settings when the test
+// ends and unsets the LOGIN_* variables for it.
+func saveLoginThrottleSettings(t *testing.T) {
+	t.Helper()
+	maxFailures, maxIPFailures, window, lockout := loginMaxFailures, loginMaxIPFailures, loginFailureWindow, loginLockout
+	t.Cleanup(func() {
+		loginMaxFailures, loginMaxIPFailures, loginFailureWindow, loginLockout = maxFailures, maxIPFailures, window, lockout
+	})
+	for _, name := range []string{"LOGIN_MAX_FAILURES", "LOGIN_MAX_IP_FAILURES", "LOGIN_FAILURE_WINDOW", "LOGIN_LOCKOUT_DURATION"} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestLoadLoginThrottleSettings(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantFailure int
+		wantLockout time.Duration
+		wantErr     bool
+	}{
+		{"defaults", nil, 5, 15 * time.Minute, false},
+		{"overrides", map[string]string{"LOGIN_MAX_FAILURES": "3", "LOGIN_LOCKOUT_DURATION": "1h"}, 3, time.Hour, false},
+		{"zero failures", map[string]string{"LOGIN_MAX_FAILURES": "0"}, 0, 0, true},
+		{"IP failures not a number", map[string]string{"LOGIN_MAX_IP_FAILURES": "many"}, 0, 0, true},
+		{"zero window", map[string]string{"LOGIN_FAILURE_WINDOW": "0s"}, 0, 0, true},
+		{"lockout without unit", map[string]string{"LOGIN_LOCKOUT_DURATION": "15"}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saveLoginThrottleSettings(t)
+			loginMaxFailures, loginLockout = 5, 15*time.Minute
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			err := loadLoginThrottleSettings()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("loadLoginThrottleSettings() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loginMaxFailures != tt.wantFailure || loginLockout != tt.wantLockout {
+				t.Errorf("max failures, lockout = %d, %v, want %d, %v", loginMaxFailures, loginLockout, tt.wantFailure, tt.wantLockout)
+			}
+		})
+	}
+}
+
+func TestLoginDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{7, 16 * time.Second},
+		{8, loginMaxDelay},
+		{1000, loginMaxDelay},
+	}
+	for _, tt := range tests {
+		if got := loginDelay(tt.failures); got != tt.want {
+			t.Errorf("loginDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginWait(t *testing.T) {
+	saveLoginThrottleSettings(t)
+	loginFailureWindow, loginLockout = 15*time.Minute, 15*time.Minute
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	email, ip := loginEmailKey("student@example.com"), loginIPKey("203.0.113.7")
+
+	tests := []struct {
+		name     string
+		counters []LoginAttempts
+		want     time.Duration
+	}{
+		{"no counters", nil, 0},
+		{"free failures", []LoginAttempts{{Key: email, Failures: 2, LastFailureAt: now}}, 0},
+		{"delay after free failures", []LoginAttempts{{Key: email, Failures: 3, LastFailureAt: now}}, time.Second},
+		{"delay partly waited", []LoginAttempts{{Key: email, Failures: 5, LastFailureAt: now.Add(-3 * time.Second)}}, time.Second},
+		{"delay over", []LoginAttempts{{Key: email, Failures: 5, LastFailureAt: now.Add(-time.Minute)}}, 0},
+		{"failures outside the window", []LoginAttempts{{Key: email, Failures: 50, LastFailureAt: now.Add(-16 * time.Minute)}}, 0},
+		{
+			"locked account",
+			[]LoginAttempts{{Key: email, Failures: 5, LastFailureAt: now.Add(-time.Minute), LockedUntil: now.Add(14 * time.Minute)}},
+			14 * time.Minute,
+		},
+		{
+			// The lock holds even once the failures fall outside the window
+			"lock outlasting the window",
+			[]LoginAttempts{{Key: email, Failures: 5, LastFailureAt: now.Add(-20 * time.Minute), LockedUntil: now.Add(time.Minute)}},
+			time.Minute,
+		},
+		{
+			"lock expired",
+			[]LoginAttempts{{Key: email, Failures: 5, LastFailureAt: now.Add(-20 * time.Minute), LockedUntil: now.Add(-5 * time.Minute)}},
+			0,
+		},
+		{"address failures are not delayed", []LoginAttempts{{Key: ip, Failures: 30, LastFailureAt: now}}, 0},
+		{"locked address", []LoginAttempts{{Key: ip, Failures: 50, LastFailureAt: now, LockedUntil: now.Add(15 * time.Minute)}}, 15 * time.Minute},
+		{
+			"longest wait wins",
+			[]LoginAttempts{
+				{Key: email, Failures: 4, LastFailureAt: now},
+				{Key: ip, Failures: 50, LastFailureAt: now, LockedUntil: now.Add(10 * time.Minute)},
+			},
+			10 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := loginWait(tt.counters, now); got != tt.want {
+				t.Errorf("loginWait() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
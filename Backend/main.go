@@ -2,22 +2,18 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
+	"log/slog"
 	"mime"
 	"net/http"
-	"net/smtp"
-	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"sort"
-	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -69,16 +65,17 @@ type User struct {
 	Password string `json:"password" bson:"password"`
 	OTP      string `json:"otp,omitempty" bson:"otp,omitempty"`
 	Role     string `json:"role" bson:"role"`
-	LoggedIn string `json:"LoggedIn" bson:"loggedIn"`
+	Status   string `json:"status,omitempty" bson:"status,omitempty"`
+	// Set by admins, see users.go
+	DeactivatedAt         *time.Time `json:"deactivated_at,omitempty" bson:"deactivated_at,omitempty"`
+	PasswordResetRequired bool       `json:"password_reset_required,omitempty" bson:"password_reset_required,omitempty"`
+	TwoFactorRequired     bool       `json:"two_factor_required,omitempty" bson:"two_factor_required,omitempty"`
 }
 type LeaderboardEntry struct {
 	Username string `bson:"username"`
 	Points   int    `bson:"points"`
 }
 
-var otpStorage = make(map[string]string)
-var otpMutex sync.Mutex
-
 // MongoDB collection
 var userCollection *mongo.Collection
 var detailsCollection *mongo.Collection
@@ -88,28 +85,118 @@ var leaderboardCollection *mongo.Collection
 var quizCollection *mongo.Collection
 var submissionCollection *mongo.Collection
 
-// Initialize MongoDB connection
-func init() {
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+// bootstrap loads the configuration, connects to MongoDB and prepares every
+// store. The caller owns the returned client and disconnects it on shutdown.
+func bootstrap(ctx context.Context) (*mongo.Client, error) {
+	var err error
+	config, err = LoadConfig()
 	if err != nil {
-		log.Fatalf("MongoDB Connection Error: %v", err)
+		return nil, err
 	}
-	err = client.Ping(context.TODO(), nil)
+	setupLogging(config)
+
+	client, err := connectMongo(ctx, config.MongoURI)
 	if err != nil {
-		log.Fatalf("MongoDB Ping Error: %v", err)
+		return nil, fmt.Errorf("mongodb: %v", err)
+	}
+	slog.Info("Connected to MongoDB", "database", config.Database)
+	mongoClient = client
+	if err := initStores(ctx, client.Database(config.Database)); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
 	}
-	fmt.Println("Connected to MongoDB!")
-	userCollection = client.Database("User2").Collection("users")
-	detailsCollection = client.Database("User2").Collection("details")
-	coursesCollection = client.Database("User2").Collection("courses")
-	assignmentsCollection = client.Database("User2").Collection("assignments")
-	leaderboardCollection = client.Database("User2").Collection("leaderboard")
-	quizCollection = client.Database("User2").Collection("quiz")
-	submissionCollection = client.Database("User2").Collection("submissions")
+	return client, nil
+}
+
+// initStores points the collection variables at db, creates their indexes
+// and reads the settings of each subsystem.
+func initStores(ctx context.Context, db *mongo.Database) error {
+	var err error
+	userCollection = db.Collection("users")
+	detailsCollection = db.Collection("details")
+	coursesCollection = db.Collection("courses")
+	assignmentsCollection = db.Collection("assignments")
+	leaderboardCollection = db.Collection("leaderboard")
+	quizCollection = db.Collection("quiz")
+	submissionCollection = db.Collection("submissions")
+	sessionCollection = db.Collection("sessions")
+	otpCollection = db.Collection("otps")
+	passwordResetCollection = db.Collection("password_resets")
+	emailJobCollection = db.Collection("email_jobs")
+	loginAttemptCollection = db.Collection("login_attempts")
+	courseStaffCollection = db.Collection("course_staff")
+	apiTokenCollection = db.Collection("api_tokens")
+	twoFactorCollection = db.Collection("two_factor")
+	loginChallengeCollection = db.Collection("login_challenges")
+	oidcStateCollection = db.Collection("oidc_states")
+	impersonationEventCollection = db.Collection("impersonation_events")
+	auditCollection = db.Collection("audit_events")
 
 	// Ensure base upload directory exists
-	os.MkdirAll("uploads", os.ModePerm)
+	if err := os.MkdirAll(config.UploadsDir, os.ModePerm); err != nil {
+		return fmt.Errorf("uploads directory: %v", err)
+	}
+
+	mailer, err = NewMailerFromEnv()
+	if err != nil {
+		return fmt.Errorf("mailer configuration: %v", err)
+	}
+	if err := loadEmailTemplates(); err != nil {
+		return fmt.Errorf("email template: %v", err)
+	}
+
+	tokens, err = NewTokenServiceFromEnv()
+	if err != nil {
+		return fmt.Errorf("jwt configuration: %v", err)
+	}
+	if err := initSessions(ctx); err != nil {
+		return fmt.Errorf("session store: %v", err)
+	}
+	if err := initOTPStore(ctx); err != nil {
+		return fmt.Errorf("otp store: %v", err)
+	}
+	if err := initPasswordResets(ctx); err != nil {
+		return fmt.Errorf("password reset store: %v", err)
+	}
+	if err := initEmailQueue(ctx); err != nil {
+		return fmt.Errorf("email queue: %v", err)
+	}
+	initUserIndexes(ctx)
+	if err := initLoginThrottle(ctx); err != nil {
+		return fmt.Errorf("login throttle: %v", err)
+	}
+	if err := initCourseStaff(ctx); err != nil {
+		return fmt.Errorf("course staff: %v", err)
+	}
+	if err := initAPITokens(ctx); err != nil {
+		return fmt.Errorf("api token store: %v", err)
+	}
+	if err := initTwoFactor(ctx); err != nil {
+		return fmt.Errorf("two-factor store: %v", err)
+	}
+	oidcConfig, err = NewOIDCConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("oidc configuration: %v", err)
+	}
+	if err := initOIDC(ctx); err != nil {
+		return fmt.Errorf("oidc state store: %v", err)
+	}
+	if err := initInvitations(); err != nil {
+		return fmt.Errorf("invitation configuration: %v", err)
+	}
+	if err := initImpersonation(ctx); err != nil {
+		return fmt.Errorf("impersonation log: %v", err)
+	}
+	if err := initAudit(ctx); err != nil {
+		return fmt.Errorf("audit log: %v", err)
+	}
+	if err := initPasswordPolicy(); err != nil {
+		return fmt.Errorf("password policy: %v", err)
+	}
+	if err := initMetrics(); err != nil {
+		return fmt.Errorf("metrics: %v", err)
+	}
+	return nil
 }
 
 // Function to hash passwords
@@ -124,8 +211,9 @@ func CheckPasswordHash(password, hash string) bool {
 }
 
 func AddUserDetails(c *gin.Context) {
+	// The details always belong to the logged in user
+	email := c.GetString("email")
 	// Extract form-data
-	email := c.PostForm("email")
 	fullName := c.PostForm("full_name")
 	age := c.PostForm("age")
 	address := c.PostForm("address")
@@ -143,10 +231,10 @@ func AddUserDetails(c *gin.Context) {
 
 	// Convert email to folder-friendly format
 	emailFolder := sanitizeEmail(email)
-	userFolder := filepath.Join("uploads", emailFolder)
+	userFolder := uploadPath(emailFolder)
 
 	if err := os.MkdirAll(userFolder, os.ModePerm); err != nil {
-		log.Printf("Error creating user directory: %v", err)
+		requestLog(c).Error("Failed to create user directory", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user folder", "details": err.Error()})
 		return
 	}
@@ -163,6 +251,7 @@ func AddUserDetails(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save profile photo"})
 		return
 	}
+	observeUpload(c, uploadKindPhoto, photo.Size)
 
 	// Save details to MongoDB
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -193,8 +282,23 @@ func AddUserDetails(c *gin.Context) {
 
 
 func UpdateUserDetails(c *gin.Context) {
+	updateUserDetails(c, c.GetString("email"))
+}
+
+// UpdateUserDetailsFor is the admin variant of UpdateUserDetails for the
+// user in :email.
+func UpdateUserDetailsFor(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	updateUserDetails(c, user.Email)
+}
+
+func updateUserDetails(c *gin.Context, email string) {
 	// Extract form-data
-	email := c.PostForm("email")
 	fullName := c.PostForm("full_name")
 	age := c.PostForm("age")
 	address := c.PostForm("address")
@@ -212,7 +316,7 @@ func UpdateUserDetails(c *gin.Context) {
 
 	// Convert email to folder-friendly format
 	emailFolder := sanitizeEmail(email)
-	userFolder := filepath.Join("uploads", emailFolder)
+	userFolder := uploadPath(emailFolder)
 
 	// Create update document
 	updateData := bson.M{
@@ -232,7 +336,7 @@ func UpdateUserDetails(c *gin.Context) {
 	if err == nil { // No error means a file was uploaded
 		// Ensure user directory exists
 		if err := os.MkdirAll(userFolder, os.ModePerm); err != nil {
-			log.Printf("Error creating user directory: %v", err)
+			requestLog(c).Error("Failed to create user directory", "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user folder", "details": err.Error()})
 			return
 		}
@@ -243,6 +347,7 @@ func UpdateUserDetails(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save profile photo"})
 			return
 		}
+		observeUpload(c, uploadKindPhoto, photo.Size)
 
 		// Add photo path to update data
 		updateData["photo_path"] = photoPath
@@ -258,7 +363,7 @@ func UpdateUserDetails(c *gin.Context) {
 
 	result, err := detailsCollection.UpdateOne(ctx, filter, update, options)
 	if err != nil {
-		log.Printf("Error updating user details: %v", err)
+		requestLog(c).Error("Failed to update user details", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user details"})
 		return
 	}
@@ -290,15 +395,24 @@ if _, hasPhoto := updateData["photo_path"]; hasPhoto {
 }
 
 func GetUserDetails(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	getUserDetails(c, c.GetString("email"))
+}
 
-	email := c.Param("email")          // Get email from URL parameter
-	_, err := url.QueryUnescape(email) // Decode %40 to @
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email format"})
+// GetUserDetailsFor is the admin variant of GetUserDetails for the user in
+// :email.
+func GetUserDetailsFor(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
 		return
 	}
+	getUserDetails(c, user.Email)
+}
+
+func getUserDetails(c *gin.Context, email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
 	if email == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is required"})
@@ -306,8 +420,8 @@ func GetUserDetails(c *gin.Context) {
 	}
 	// Find user by email (case-insensitive)
 	var userDetails bson.M
-	filter := bson.M{"email": bson.M{"$regex": "^" + email + "$", "$options": "i"}}
-	err = detailsCollection.FindOne(ctx, filter).Decode(&userDetails)
+	filter := bson.M{"email": bson.M{"$regex": "^" + regexp.QuoteMeta(email) + "$", "$options": "i"}}
+	err := detailsCollection.FindOne(ctx, filter).Decode(&userDetails)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			c.JSON(http.StatusNotFound, gin.H{"error": "User details not found"})
@@ -325,19 +439,26 @@ func VerifyPayment(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	filter := bson.M{"email": email}
+	filter := bson.M{"email": email, "payment_status": bson.M{"$ne": "Verified"}}
 	update := bson.M{"$set": bson.M{"payment_status": "Verified"}}
 
-	result, err := detailsCollection.UpdateOne(ctx, filter, update)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update payment status"})
+	var previous UserDetails
+	err := detailsCollection.FindOneAndUpdate(ctx, filter, update).Decode(&previous)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found or already verified"})
 		return
 	}
-
-	if result.ModifiedCount == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found or already verified"})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update payment status"})
 		return
 	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditVerifyPayment,
+		TargetType: auditTargetUser,
+		Target:     email,
+		Before:     bson.M{"payment_status": previous.PaymentStatus},
+		After:      bson.M{"payment_status": "Verified"},
+	})
 
 	c.JSON(http.StatusOK, gin.H{"message": "Payment status updated to Verified"})
 }
@@ -350,48 +471,81 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	// Check if user already exists
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	input.Username = strings.TrimSpace(input.Username)
+	if input.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username is required"})
+		return
+	}
+	email, ok := normalizeEmail(input.Email)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+		return
+	}
+
+	// Check if user already exists, ignoring case
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	caseInsensitiveFind := options.FindOne().SetCollation(caseInsensitive)
 	var existingUser User
-	err := userCollection.FindOne(ctx, bson.M{"username": input.Username}).Decode(&existingUser)
+	err := userCollection.FindOne(ctx, bson.M{"username": input.Username}, caseInsensitiveFind).Decode(&existingUser)
 	if err == nil {
 		c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
 		return
 	}
+	err = userCollection.FindOne(ctx, bson.M{"email": email}, caseInsensitiveFind).Decode(&existingUser)
+	if err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already registered"})
+		return
+	}
+	if !validatePassword(c, input.Password, input.Username, email) {
+		return
+	}
 	// Hash the password before storing
 	hashedPassword, err := HashPassword(input.Password)
 	if err != nil {
-		fmt.Println("User not found in DB:", err)
+		requestLog(c).Error("Failed to hash password", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
 	}
-	// Save user to MongoDB
+	// Save user to MongoDB; the account stays pending until the email is verified
 	newUser := User{
 		Username: input.Username,
-		Email:    input.Email,
+		Email:    email,
 		Password: hashedPassword,
 		Role:     "student",
-		LoggedIn: "False",
+		Status:   userStatusPendingVerification,
 	}
 	_, err = userCollection.InsertOne(ctx, newUser)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username or email already exists"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		}
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"success": true, "message": "User registered successfully!"})
 	leaderboardEntry := bson.M{"username": input.Username, "points": 0}
 	_, err = leaderboardCollection.InsertOne(ctx, leaderboardEntry)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initialize leaderboard entry"})
 		return
 	}
+	if err := sendVerificationEmail(ctx, newUser); err != nil {
+		requestLog(c).Error("Verification email not queued", "email", email, "error", err)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":             true,
+		"message":             "User registered successfully! Check your email for the verification code.",
+		"pendingVerification": true,
+	})
 }
 
-var jwtKey = []byte("your_secret_key") // Change this to a secure key
 type Claims struct {
-	Email string `json:"email"`
+	Email     string `json:"email"`
+	SessionID string `json:"sid"`
+	// ImpersonatedBy is the admin using the token to act as Email
+	ImpersonatedBy string `json:"imp,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -404,105 +558,130 @@ func Login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
-	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	// Refuse locked or too frequent attempts before spending time on bcrypt
+	if !throttleLogin(c, ctx, input.Email) {
+		return
+	}
 	// Find user by email
-	err := userCollection.FindOne(ctx, bson.M{"email": input.Email}).Decode(&user)
+	user, err := findUserByEmail(ctx, input.Email)
 	if err != nil || !CheckPasswordHash(input.Password, user.Password) {
-		fmt.Println("User not found in DB:", err)
-		fmt.Println("Querying for email:", input.Email)
+		loginFailed(c, ctx, input.Email)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
-
-	expirationTime := time.Now().Add(7 * 24 * time.Hour) // Token valid for 7 days
-	claims := Claims{
-		Email: user.Email,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
+	if user.DeactivatedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account deactivated"})
+		return
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+	if user.Status == userStatusPendingVerification {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email not verified", "pendingVerification": true})
+		return
+	}
+	if user.PasswordResetRequired {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Password reset required, check your email for a reset code", "passwordResetRequired": true})
 		return
 	}
-	// Update login status in DB
-	_, err = userCollection.UpdateOne(ctx, bson.M{"email": input.Email}, bson.M{"$set": bson.M{"loggedIn": "true"}})
+	// With 2FA the tokens are only issued by LoginSecondFactor
+	tf, err := loadTwoFactor(ctx, user.Email)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update login status"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor settings"})
 		return
 	}
-	// Send token to frontend
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Login successful!",
-		"token":   tokenString,
-	})
+	enrolled := tf != nil && tf.Enabled
+	if enrolled || twoFactorRequired(user) {
+		challenge, err := startLoginChallenge(ctx, user.Email)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor login"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":                "Two-factor authentication required",
+			"twoFactorRequired":      true,
+			"twoFactorSetupRequired": !enrolled,
+			"challengeToken":         challenge,
+		})
+		return
+	}
+	loginSucceeded(ctx, user.Email)
+
+	response, ok := startLoginSession(c, ctx, user.Email)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, response)
 }
 
+// startLoginSession starts a server-side session so the login can be
+// revoked, and builds the token response for it. It writes the error
+// response itself when that fails.
+func startLoginSession(c *gin.Context, ctx context.Context, email string) (gin.H, bool) {
+	session, refreshToken, err := createSession(ctx, c, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return nil, false
+	}
+	response, err := sessionTokenResponse(session, refreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return nil, false
+	}
+	// Send tokens to frontend
+	response["message"] = "Login successful!"
+	return response, true
+}
+
+// VerifyToken checks the token signature and expiry and that the session it
+// belongs to has not been revoked.
 func VerifyToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	claims, err := tokens.Parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session, err := loadActiveSession(ctx, claims.SessionID)
 	if err != nil {
 		return nil, err
 	}
-	// Extract claims properly
-	claims, ok := token.Claims.(*Claims)
-	if !ok || !token.Valid {
-		return nil, errors.New("invalid token")
+	if !sessionMatchesClaims(session, claims) {
+		return nil, errSessionInactive
+	}
+	if err := touchSession(ctx, session); err != nil {
+		slog.Warn("Failed to record session use", "session_id", claims.SessionID, "error", err)
 	}
 	return claims, nil
 }
 
+// Logout revokes the session of the access token the request came with.
 func Logout(c *gin.Context) {
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization token required"})
-		return
-	}
-	// Extract token from "Bearer <token>"
-	authParts := strings.Split(authHeader, " ")
-	if len(authParts) != 2 || authParts[0] != "Bearer" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token format"})
-		return
-	}
-	tokenString := authParts[1]
-	// Verify and parse the JWT token
-	claims, err := VerifyToken(tokenString)
+	sessionID, err := primitive.ObjectIDFromHex(c.GetString("session_id"))
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
-		return
-	}
-	// Extract email from claims
-	email := claims.Email
-	if email == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token data"})
 		return
 	}
-	// Update user's login status in MongoDB
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, err = userCollection.UpdateOne(ctx, bson.M{"email": email}, bson.M{"$set": bson.M{"loggedIn": "false"}})
-	if err != nil {
+	// Revoke the session so the token stops working immediately
+	if err := revokeSession(ctx, sessionID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update logout status"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully!"})
-}
-
-func GetEmailFromSession(c *gin.Context) (string, error) {
-	email, err := c.Cookie("session")
-	if err != nil {
-		return "", err
+	if admin := c.GetString("impersonated_by"); admin != "" {
+		err := recordImpersonation(ctx, c, ImpersonationEvent{
+			Action:    impersonationStop,
+			Admin:     admin,
+			Target:    c.GetString("email"),
+			SessionID: sessionID.Hex(),
+		})
+		if err != nil {
+			requestLog(c).Error("Failed to record end of impersonation", "session_id", sessionID.Hex(), "error", err)
+		}
 	}
-	return email, nil
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully!"})
 }
 
-var secretKey = []byte("your_secret_key")
-
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get the Authorization header
@@ -515,35 +694,100 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 		// Extract the token from "Bearer <token>"
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		// Parse and validate JWT
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if strings.HasPrefix(tokenString, apiTokenPrefix) {
+			// Personal access token, limited to the routes its scopes allow
+			token, err := verifyAPIToken(ctx, tokenString)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid token"})
+				c.Abort()
+				return
+			}
+			if !apiTokenAllows(token, c.Request.Method, c.FullPath()) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Token scope does not allow this request"})
+				c.Abort()
+				return
+			}
+			c.Set("email", token.Email)
+			c.Set("api_token_id", token.ID.Hex())
+		} else {
+			// Parse and validate JWT, including its expiry
+			claims, err := VerifyToken(tokenString)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid token"})
+				c.Abort()
+				return
+			}
+			if claims.Email == "" {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid claims"})
+				c.Abort()
+				return
+			}
+			// Store email and session in context for further use
+			c.Set("email", claims.Email)
+			c.Set("session_id", claims.SessionID)
+			if claims.ImpersonatedBy != "" {
+				if !impersonationAllows(c.Request.Method, c.FullPath()) {
+					c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Read-only while impersonating"})
+					c.Abort()
+					return
+				}
+				c.Set("impersonated_by", claims.ImpersonatedBy)
+			}
+		}
+		// Deactivated or deleted accounts are refused even with a live token
+		if err := checkAccountActive(ctx, c.GetString("email")); err != nil {
+			switch err {
+			case errAccountDeactivated:
+				c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Account deactivated"})
+			case mongo.ErrNoDocuments:
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: User not found"})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
 			}
-			return secretKey, nil
-		})
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid token"})
 			c.Abort()
 			return
 		}
-		// Extract email from token claims
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid claims"})
+		// Proceed with the request
+		c.Next()
+	}
+}
+
+// RequireRole loads the role of the user authenticated by AuthMiddleware and
+// rejects the request unless it is one of the allowed roles. It must be
+// registered after AuthMiddleware.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		email := c.GetString("email")
+		if email == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Missing user identity"})
 			c.Abort()
 			return
 		}
-		// Check token expiration
-		if float64(time.Now().Unix()) > claims["exp"].(float64) {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Token expired"})
+		var user User
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := userCollection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: User not found"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user role"})
+			}
 			c.Abort()
 			return
 		}
-		// Store email in context for further use
-		c.Set("email", claims["email"])
-		// Proceed with the request
-		c.Next()
+		for _, role := range roles {
+			if user.Role == role {
+				// Store role in context for handlers that need it
+				c.Set("role", user.Role)
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Insufficient permissions"})
+		c.Abort()
 	}
 }
 
@@ -581,80 +825,79 @@ func CheckLoginStatus(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"loggedIn": false, "error": "Unauthorized: User not found"})
 		return
 	}
-	// Return success response
-	c.JSON(http.StatusOK, gin.H{"loggedIn": user.LoggedIn, "email": email})
+	// The token was only accepted because its session is still active
+	response := gin.H{"loggedIn": true, "email": email}
+	if claims.ImpersonatedBy != "" {
+		response["impersonatedBy"] = claims.ImpersonatedBy
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 func getusername(c *gin.Context) {
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"Username": "nil", "error": "Unauthorized: Missing token"})
-		return
-	}
-	// Extract token from "Bearer <token>"
-	authParts := strings.Split(authHeader, " ")
-	if len(authParts) != 2 || authParts[0] != "Bearer" {
-		c.JSON(http.StatusUnauthorized, gin.H{"Username": "nil", "error": "Unauthorized: Invalid token format"})
-		return
-	}
-	tokenString := authParts[1]
-	// Verify token and extract claims
-	claims, err := VerifyToken(tokenString)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"Username": "nil", "error": "Unauthorized: Invalid or expired token"})
-		return
-	}
-	// Extract email from claims
-	email := claims.Email
-	if email == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"Username": "nil", "error": "Unauthorized: Invalid token data"})
-		return
-	}
-	// Check if the user exists in the database
-	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	err = userCollection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"Username": "nil", "error": "Unauthorized: User not found"})
+	user, ok := currentUser(c, ctx)
+	if !ok {
 		return
 	}
-	// Return success response
-	c.JSON(http.StatusOK, gin.H{"loggedIn": user.Username, "email": email})
+	c.JSON(http.StatusOK, gin.H{"loggedIn": user.Username, "email": user.Email})
 }
 
-// Generate OTP
-func GenerateOTP() string {
-	return strconv.Itoa(100000 + rand.Intn(900000))
-}
-
-// Send OTP via email
-func SendOTP(email, otp string) error {
-	from := "webpage.krctc.project@gmail.com"
-	password := "umzy cqxf odzr qeyj"
-	to := []string{email}
-	smtpHost := "smtp.gmail.com"
-	smtpPort := "587"
-	message := []byte("Subject: Your OTP Code\n\nYour OTP is: " + otp)
-	auth := smtp.PlainAuth("", from, password, smtpHost)
-	return smtp.SendMail(smtpHost+":"+smtpPort, auth, from, to, message)
+// Queue the OTP email; delivery and retries happen in the background
+func SendOTP(ctx context.Context, email, otp, purpose string) error {
+	name := emailOTP
+	if purpose == otpPurposeResetPassword {
+		name = emailPasswordReset
+	}
+	return enqueueEmail(ctx, name, gin.H{"OTP": otp, "ExpiresInMinutes": int(otpTTL.Minutes())}, email)
 }
 
 func RequestOTP1(c *gin.Context) {
 	var input struct {
-		Email string `json:"email"`
+		Email   string `json:"email"`
+		Purpose string `json:"purpose"`
 	}
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
-	otp := GenerateOTP()
-	// Store OTP temporarily in memory
-	otpMutex.Lock()
-	otpStorage[input.Email] = otp
-	otpMutex.Unlock()
+	if input.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is required"})
+		return
+	}
+	purpose, ok := parseOTPPurpose(input.Purpose)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OTP purpose"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if purpose == otpPurposeResetPassword {
+		// Answer the same way for unknown emails so accounts can't be probed
+		count, err := userCollection.CountDocuments(ctx, bson.M{"email": input.Email})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate OTP"})
+			return
+		}
+		if count == 0 {
+			c.JSON(http.StatusOK, gin.H{"message": "OTP sent successfully!"})
+			return
+		}
+	}
+	// Store hashed OTP in MongoDB
+	otp, err := issueOTP(ctx, input.Email, purpose)
+	if err != nil {
+		if err == errOTPCooldown {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "OTP already sent, please wait before requesting another"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate OTP"})
+		}
+		return
+	}
 	// Send OTP via email
-	if err := SendOTP(input.Email, otp); err != nil {
+	if err := SendOTP(ctx, input.Email, otp, purpose); err != nil {
+		// Let the user retry straight away instead of waiting for the cooldown
+		discardOTP(ctx, input.Email, purpose)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send OTP"})
 		return
 	}
@@ -681,54 +924,83 @@ func GetAllStudents(c *gin.Context) {
 // Verify OTP
 func VerifyOTP1(c *gin.Context) {
 	var input struct {
-		Email string `json:"email"`
-		OTP   string `json:"otp"`
+		Email   string `json:"email"`
+		OTP     string `json:"otp"`
+		Purpose string `json:"purpose"`
 	}
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
-	otpMutex.Lock()
-	storedOTP, exists := otpStorage[input.Email]
-	otpMutex.Unlock()
-	if !exists || storedOTP != input.OTP {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid OTP"})
+	purpose, ok := parseOTPPurpose(input.Purpose)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OTP purpose"})
 		return
 	}
-	// OTP Verified Successfully - Remove it from storage
-	otpMutex.Lock()
-	delete(otpStorage, input.Email)
-	otpMutex.Unlock()
-	c.JSON(http.StatusOK, gin.H{"message": "OTP verified successfully!"})
-}
-
-func userm(c *gin.Context) {
-	email, err := GetEmailFromSession(c)
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{"loggedIn": false, "em": email})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// A verified OTP is consumed and cannot be used again
+	if err := verifyOTP(ctx, input.Email, purpose, input.OTP); err != nil {
+		switch err {
+		case errOTPInvalid:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid OTP"})
+		case errOTPExpired:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "OTP expired, please request a new one"})
+		case errOTPTooManyAttempts:
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, please request a new OTP"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify OTP"})
+		}
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"loggedIn": email})
+	if purpose == otpPurposeResetPassword {
+		// Hand out a single-use token that ForgotPassword requires
+		resetToken, err := issueResetToken(ctx, input.Email)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reset token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "OTP verified successfully!", "resetToken": resetToken})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "OTP verified successfully!"})
 }
 
+// CheckUserRole returns the role of the logged in user and the courses they
+// are staff of.
 func CheckUserRole(c *gin.Context) {
-	var input struct {
-		Email string `json:"email"`
-	}
-	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := currentUser(c, ctx)
+	if !ok {
 		return
 	}
-	var user User
+	userRole(c, ctx, user)
+}
+
+// CheckUserRoleFor is the admin variant of CheckUserRole for the user in
+// :email.
+func CheckUserRoleFor(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	err := userCollection.FindOne(ctx, bson.M{"email": input.Email}).Decode(&user)
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	userRole(c, ctx, user)
+}
+
+func userRole(c *gin.Context, ctx context.Context, user User) {
+	courses, err := staffCourses(ctx, user.Email)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load course permissions"})
 		return
 	}
-	// c.JSON(http.StatusOK, gin.H{"role": user.Role})
-	c.JSON(http.StatusOK, gin.H{"isAdmin": user.Role == "admin"})
+	c.JSON(http.StatusOK, gin.H{
+		"isAdmin": user.Role == roleAdmin,
+		"role":    user.Role,
+		"courses": courses,
+	})
 }
 
 type Course struct {
@@ -752,7 +1024,7 @@ func createCourse(c *gin.Context) {
 	}
 
 	// Create resource directory for the course
-	courseDir := filepath.Join("uploads", "courses", course.Name, "resources")
+	courseDir := uploadPath("courses", course.Name, "resources")
 	if err := os.MkdirAll(courseDir, os.ModePerm); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create course directory"})
 		return
@@ -786,11 +1058,11 @@ func uploadResource(c *gin.Context) {
 	// Validate HTML files explicitly
 	ext := filepath.Ext(handler.Filename)
 	if ext == ".html" || ext == ".htm" {
-		log.Println("Uploading an HTML file:", handler.Filename)
+		requestLog(c).Info("HTML resource uploaded", "course", courseName, "file", handler.Filename)
 	}
 
 	// Create directory for course resources
-	courseDir := filepath.Join("uploads", "courses", courseName, "resources")
+	courseDir := uploadPath("courses", courseName, "resources")
 	if err := os.MkdirAll(courseDir, os.ModePerm); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create course directory"})
 		return
@@ -808,10 +1080,12 @@ func uploadResource(c *gin.Context) {
 	defer dst.Close()
 
 	// Ensure full file write
-	if _, err = io.Copy(dst, file); err != nil {
+	written, err := io.Copy(dst, file)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write file"})
 		return
 	}
+	observeUpload(c, uploadKindResource, written)
 
 	// Update DB with correct file path
 	_, err = coursesCollection.UpdateOne(context.TODO(),
@@ -852,7 +1126,7 @@ func uploadTextNote(c *gin.Context) {
 	}
 
 	// Create the notes directory for the specific course
-	notesDir := filepath.Join("uploads", "courses", courseName, "notes")
+	notesDir := uploadPath("courses", courseName, "notes")
 	if err := os.MkdirAll(notesDir, os.ModePerm); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create notes directory"})
 		return
@@ -886,7 +1160,7 @@ func downloadNotes(c *gin.Context) {
 	noteName := c.Param("note")
 
 	// Construct the file path for the note
-	noteFilePath := filepath.Join("uploads", "courses", courseName, "notes", noteName)
+	noteFilePath := uploadPath("courses", courseName, "notes", noteName)
 
 	// Check if the note file exists
 	if _, err := os.Stat(noteFilePath); os.IsNotExist(err) {
@@ -962,7 +1236,7 @@ func getCourseResources(c *gin.Context) {
 	}
 
 	// Read all notes from the "notes" directory
-	notesDir := filepath.Join("uploads", "courses", courseName, "notes")
+	notesDir := uploadPath("courses", courseName, "notes")
 	var notes []string
 
 	if files, err := os.ReadDir(notesDir); err == nil {
@@ -989,7 +1263,7 @@ func downloadResource(c *gin.Context) {
 	courseName := c.Param("course")
 	resourceName := c.Param("resource")
 
-	filePath := filepath.Join("uploads", "courses", courseName, "resources", resourceName)
+	filePath := uploadPath("courses", courseName, "resources", resourceName)
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Resource not found"})
 		return
@@ -1043,7 +1317,7 @@ func createAssignment(c *gin.Context) {
 	}
 
 	// ✅ Create assignment directory
-	assignmentDir := filepath.Join("uploads", "courses", courseName, "assignments", assignmentName)
+	assignmentDir := uploadPath("courses", courseName, "assignments", assignmentName)
 	if err := os.MkdirAll(assignmentDir, os.ModePerm); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create assignment directory"})
 		return
@@ -1060,7 +1334,9 @@ func createAssignment(c *gin.Context) {
 			return
 		}
 		defer dst.Close()
-		io.Copy(dst, file)
+		if written, err := io.Copy(dst, file); err == nil {
+			observeUpload(c, uploadKindAssignmentPDF, written)
+		}
 	}
 
 	// ✅ Store assignment in DB
@@ -1081,9 +1357,34 @@ func createAssignment(c *gin.Context) {
 }
 
 func uploadAssignment(c *gin.Context) {
-	studentName := c.Param("student")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := currentUser(c, ctx)
+	if !ok {
+		return
+	}
+	saveAssignmentSubmission(c, user.Username)
+}
+
+// uploadAssignmentFor is the admin variant of uploadAssignment that submits
+// for the student in :email.
+func uploadAssignmentFor(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	saveAssignmentSubmission(c, user.Username)
+}
+
+func saveAssignmentSubmission(c *gin.Context, studentName string) {
 	courseName := c.Param("course")
 	assignmentName := c.Param("assignment")
+	if !safePathSegment(studentName) || !safePathSegment(courseName) || !safePathSegment(assignmentName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid student, course or assignment name"})
+		return
+	}
 
 	// 📂 Parse uploaded file
 	file, handler, err := c.Request.FormFile("file")
@@ -1108,8 +1409,17 @@ func uploadAssignment(c *gin.Context) {
 		return
 	}
 
+	// ✅ Check if the assignment exists before storing anything
+	filter := bson.M{"coursename": courseName, "assignmentname": assignmentName}
+	var existingAssignment bson.M
+	err = assignmentsCollection.FindOne(context.TODO(), filter).Decode(&existingAssignment)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Assignment not found in database"})
+		return
+	}
+
 	// ✅ Create student assignment directory
-	studentDir := filepath.Join("uploads", "students", studentName, courseName, "assignments", assignmentName)
+	studentDir := uploadPath("students", studentName, courseName, "assignments", assignmentName)
 	if err := os.MkdirAll(studentDir, os.ModePerm); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create student directory"})
 		return
@@ -1123,15 +1433,8 @@ func uploadAssignment(c *gin.Context) {
 		return
 	}
 	defer dst.Close()
-	io.Copy(dst, file)
-
-	// ✅ Check if the assignment exists
-	filter := bson.M{"coursename": courseName, "assignmentname": assignmentName}
-	var existingAssignment bson.M
-	err = assignmentsCollection.FindOne(context.TODO(), filter).Decode(&existingAssignment)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Assignment not found in database"})
-		return
+	if written, err := io.Copy(dst, file); err == nil {
+		observeUpload(c, uploadKindSubmission, written)
 	}
 
 	// ✅ Update MongoDB - Add submission to assignment
@@ -1160,7 +1463,28 @@ func uploadAssignment(c *gin.Context) {
 }
 
 func checkAssignmentSubmission(c *gin.Context) {
-	studentName := c.Param("student")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := currentUser(c, ctx)
+	if !ok {
+		return
+	}
+	findAssignmentSubmission(c, user.Username)
+}
+
+// checkAssignmentSubmissionFor is the admin variant of
+// checkAssignmentSubmission for the student in :email.
+func checkAssignmentSubmissionFor(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	findAssignmentSubmission(c, user.Username)
+}
+
+func findAssignmentSubmission(c *gin.Context, studentName string) {
 	courseName := c.Param("course")
 	assignmentName := c.Param("assignment")
 
@@ -1247,35 +1571,71 @@ func gradeAssignment(c *gin.Context) {
 		return
 	}
 
-	// ✅ Update grade in MongoDB
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// ✅ Update grade in MongoDB, keeping the old one for the audit log
 	filter := bson.M{"coursename": courseName, "assignmentname": assignmentName, "submissions.student": studentName}
 	update := bson.M{"$set": bson.M{
 		"submissions.$.grade":    gradeData.Grade,
 		"submissions.$.feedback": gradeData.Feedback,
 	}}
 
-	_, err := assignmentsCollection.UpdateOne(context.TODO(), filter, update)
-	if err != nil {
+	var previous struct {
+		Submissions []bson.M `bson:"submissions"`
+	}
+	opts := options.FindOneAndUpdate().SetProjection(bson.M{"submissions.$": 1})
+	err := assignmentsCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&previous)
+	if err != nil && err != mongo.ErrNoDocuments {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update grade"})
 		return
 	}
 
+	if err == nil {
+		before := bson.M{"student": studentName}
+		if len(previous.Submissions) > 0 {
+			before["grade"] = previous.Submissions[0]["grade"]
+			before["feedback"] = previous.Submissions[0]["feedback"]
+		}
+		recordAudit(ctx, c, AuditEvent{
+			Action:     auditGradeAssignment,
+			TargetType: auditTargetAssignment,
+			Target:     assignmentName,
+			Course:     courseName,
+			Before:     before,
+			After:      bson.M{"student": studentName, "grade": gradeData.Grade, "feedback": gradeData.Feedback},
+		})
+		notifyGradeReleased(studentName, courseName, assignmentName, gradeData.Grade, gradeData.Feedback)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Grade submitted successfully"})
 }
 
-func getStudentAssignments(c *gin.Context) {
-	courseName := strings.ToLower(c.Param("course")) // Ensure lowercase matching
-
-	// Debug: Check course name and MongoDB documents
-	log.Printf("Fetching assignments for course: %s\n", courseName)
+// notifyGradeReleased emails a student that their submission was graded.
+// Failures are only logged since the grade itself is already saved.
+func notifyGradeReleased(username, course, assignment, grade, feedback string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	// Count assignments for the given course
-	count, err := assignmentsCollection.CountDocuments(context.TODO(), bson.M{"coursename": bson.M{"$regex": courseName, "$options": "i"}})
+	var user User
+	if err := userCollection.FindOne(ctx, bson.M{"username": username}).Decode(&user); err != nil {
+		slog.Warn("Grade notification skipped, user not found", "username", username, "error", err)
+		return
+	}
+	err := enqueueEmail(ctx, emailGradeReleased, gin.H{
+		"Username":   user.Username,
+		"Course":     course,
+		"Assignment": assignment,
+		"Grade":      grade,
+		"Feedback":   feedback,
+	}, user.Email)
 	if err != nil {
-		log.Println("Error counting documents:", err)
-	} else {
-		log.Printf("Found %d assignments for course: %s\n", count, courseName)
+		slog.Error("Grade notification not queued", "email", user.Email, "error", err)
 	}
+}
+
+func getStudentAssignments(c *gin.Context) {
+	courseName := strings.ToLower(c.Param("course")) // Ensure lowercase matching
 
 	// Fetch assignments
 	cursor, err := assignmentsCollection.Find(context.TODO(), 
@@ -1290,15 +1650,12 @@ func getStudentAssignments(c *gin.Context) {
 	for cursor.Next(context.TODO()) {
 		var assignment Assignment
 		if err := cursor.Decode(&assignment); err != nil {
-			log.Println("Error decoding assignment:", err)
+			requestLog(c).Warn("Skipping undecodable assignment", "course", courseName, "error", err)
 			continue
 		}
 
-		// Debug: Print fetched assignment
-		log.Printf("Fetched assignment: %+v\n", assignment)
-
 		// Check if the assignment has a PDF file
-		assignmentPath := filepath.Join("uploads", "courses", courseName, "assignments", assignment.AssignmentName, "assignment.pdf")
+		assignmentPath := uploadPath("courses", courseName, "assignments", assignment.AssignmentName, "assignment.pdf")
 		if _, err := os.Stat(assignmentPath); err == nil {
 			assignment.PDFPath = assignmentPath
 		}
@@ -1306,26 +1663,36 @@ func getStudentAssignments(c *gin.Context) {
 		assignments = append(assignments, assignment)
 	}
 
-	// Debug: Print final assignment list
-	log.Printf("Returning assignments: %+v\n", assignments)
-
 	// Return assignments list
 	c.JSON(http.StatusOK, gin.H{"assignments": assignments})
 }
 
+// pointsStep is how many points AddPoint adds and DeletePoint deducts.
+const pointsStep = 10
+
 // leaderboard
 func AddPoint(c *gin.Context) {
 	username := c.Param("username")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err := leaderboardCollection.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$inc": bson.M{"points": 10}})
-	if err != nil {
+	var previous LeaderboardEntry
+	err := leaderboardCollection.FindOneAndUpdate(ctx, bson.M{"username": username}, bson.M{"$inc": bson.M{"points": pointsStep}}).Decode(&previous)
+	if err != nil && err != mongo.ErrNoDocuments {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add points"})
 		return
 	}
+	if err == nil {
+		recordAudit(ctx, c, AuditEvent{
+			Action:     auditAddPoints,
+			TargetType: auditTargetUser,
+			Target:     username,
+			Before:     bson.M{"points": previous.Points},
+			After:      bson.M{"points": previous.Points + pointsStep},
+		})
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "10 points added"})
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("%d points added", pointsStep)})
 }
 
 func DeletePoint(c *gin.Context) {
@@ -1333,13 +1700,23 @@ func DeletePoint(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err := leaderboardCollection.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$inc": bson.M{"points": -10}})
-	if err != nil {
+	var previous LeaderboardEntry
+	err := leaderboardCollection.FindOneAndUpdate(ctx, bson.M{"username": username}, bson.M{"$inc": bson.M{"points": -pointsStep}}).Decode(&previous)
+	if err != nil && err != mongo.ErrNoDocuments {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete points"})
 		return
 	}
+	if err == nil {
+		recordAudit(ctx, c, AuditEvent{
+			Action:     auditDeductPoints,
+			TargetType: auditTargetUser,
+			Target:     username,
+			Before:     bson.M{"points": previous.Points},
+			After:      bson.M{"points": previous.Points - pointsStep},
+		})
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "10 points deducted"})
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("%d points deducted", pointsStep)})
 }
 
 func GetLeaderboard(c *gin.Context) {
@@ -1396,38 +1773,29 @@ func GetStudentLeaderboard(c *gin.Context) {
 	c.JSON(http.StatusOK, leaderboard)
 }
 func GetCourseNamesAndCount(c *gin.Context) {
-    fmt.Println("Getting course names and count...")
-    
     projection := bson.M{"name": 1}
     cursor, err := coursesCollection.Find(context.TODO(), bson.M{}, options.Find().SetProjection(projection))
     if err != nil {
-        fmt.Println("Error fetching from DB:", err)
+        requestLog(c).Error("Failed to fetch courses", "error", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch courses"})
         return
     }
 
     var results []bson.M
     if err := cursor.All(context.TODO(), &results); err != nil {
-        fmt.Println("Error parsing cursor:", err)
+        requestLog(c).Error("Failed to parse courses", "error", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse courses"})
         return
     }
 
-    fmt.Println("Query returned", len(results), "documents")
-    
     // Extract the names
     names := []string{}
     for _, result := range results {
-        fmt.Printf("Result document: %+v\n", result)
         if name, ok := result["name"].(string); ok {
             names = append(names, name)
-        } else {
-            fmt.Println("Found document without valid name field")
         }
     }
 
-    fmt.Println("Returning", len(names), "course names")
-    
     // Return count and names
     c.JSON(http.StatusOK, gin.H{
         "count": len(names),
@@ -1436,8 +1804,6 @@ func GetCourseNamesAndCount(c *gin.Context) {
 }
 
 func GetAssignmentSummary(c *gin.Context) {
-    fmt.Println("Getting assignment summary...")
-    
     // Optional course name filter from query parameters
     courseName := c.Query("course")
     
@@ -1445,38 +1811,32 @@ func GetAssignmentSummary(c *gin.Context) {
     filter := bson.M{}
     if courseName != "" {
         filter["coursename"] = courseName
-        fmt.Println("Filtering assignments for course:", courseName)
     }
     
     // Project only the fields we need
     projection := bson.M{"assignmentname": 1, "coursename": 1, "duedate": 1}
     cursor, err := assignmentsCollection.Find(context.TODO(), filter, options.Find().SetProjection(projection))
     if err != nil {
-        fmt.Println("Error fetching from DB:", err)
+        requestLog(c).Error("Failed to fetch assignments", "error", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch assignments"})
         return
     }
     
     var results []bson.M
     if err := cursor.All(context.TODO(), &results); err != nil {
-        fmt.Println("Error parsing cursor:", err)
+        requestLog(c).Error("Failed to parse assignments", "error", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse assignments"})
         return
     }
     
-    fmt.Println("Query returned", len(results), "documents")
-    
     // Extract the assignment data
     assignments := []map[string]string{}
     for _, result := range results {
-        fmt.Printf("Result document: %+v\n", result)
-        
         assignment := map[string]string{}
         
         if name, ok := result["assignmentname"].(string); ok {
             assignment["name"] = name
         } else {
-            fmt.Println("Found document without valid assignmentname field")
             continue
         }
         
@@ -1491,8 +1851,6 @@ func GetAssignmentSummary(c *gin.Context) {
         assignments = append(assignments, assignment)
     }
     
-    fmt.Println("Returning", len(assignments), "assignments")
-    
     // Return count and assignment summaries
     c.JSON(http.StatusOK, gin.H{
         "count": len(assignments),
@@ -1623,6 +1981,7 @@ func GetCurrentUserStats(c *gin.Context) {
 type Quiz struct {
 	ID        string     `json:"id" bson:"id"`
 	Title     string     `json:"title" bson:"title"`
+	Course    string     `json:"course,omitempty" bson:"course,omitempty"`
 	Questions []Question `json:"questions" bson:"questions"`
 	StartTime time.Time  `json:"startTime" bson:"startTime"`
 	EndTime   time.Time  `json:"endTime" bson:"endTime"`
@@ -1636,6 +1995,7 @@ type Question struct {
 
 type QuizInput struct {
 	Title     string     `json:"title"`
+	Course    string     `json:"course"`
 	Questions []Question `json:"questions"`
 	StartTime string     `json:"startTime"`
 	EndTime   string     `json:"endTime"`
@@ -1665,15 +2025,34 @@ func createQuiz(c *gin.Context) {
 		return
 	}
 
+	// Instructors may only create quizzes in their own courses
+	user, err := findUserByEmail(context.TODO(), c.GetString("email"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: User not found"})
+		return
+	}
+	if user.Role != roleAdmin {
+		allowed, err := hasCoursePermission(context.TODO(), user, input.Course, permContentWrite)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load course permissions"})
+			return
+		}
+		if input.Course == "" || !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Insufficient permissions"})
+			return
+		}
+	}
+
 	quiz := Quiz{
 		ID:        input.Title, // Set ID same as title
 		Title:     input.Title,
+		Course:    input.Course,
 		Questions: input.Questions,
 		StartTime: startTime,
 		EndTime:   endTime,
 	}
 
-	_, err := quizCollection.InsertOne(context.TODO(), quiz)
+	_, err = quizCollection.InsertOne(context.TODO(), quiz)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create quiz"})
 		return
@@ -1728,8 +2107,24 @@ func getQuizSubmissionsByID(c *gin.Context) {
 	})
 }
 
+// getStudentProgress is the admin variant of getMyProgress for the student
+// in :email.
 func getStudentProgress(c *gin.Context) {
-	email := c.Param("email")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	studentProgress(c, user.Email)
+}
+
+// getMyProgress is getStudentProgress for the logged in student.
+func getMyProgress(c *gin.Context) {
+	studentProgress(c, c.GetString("email"))
+}
+
+func studentProgress(c *gin.Context, email string) {
 	if email == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is required"})
 		return
@@ -1801,7 +2196,6 @@ func getStudentProgress(c *gin.Context) {
 
 func getActiveQuizzes(c *gin.Context) {
 	now := time.Now()
-	log.Println("Current time:", now)
 
 	filter := bson.M{
 		"startTime": bson.M{"$lte": now},
@@ -1827,9 +2221,10 @@ func submitQuiz(c *gin.Context) {
 	var submission Submission
 	if err := c.BindJSON(&submission); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid submission format"})
-		print("sdfsfdfsfdfsfsfdfsffd")
 		return
 	}
+	// Students can only submit for themselves, whatever the body says
+	submission.StudentID = c.GetString("email")
 
 	var user struct {
 		Email    string `bson:"email"`
@@ -1857,7 +2252,6 @@ func submitQuiz(c *gin.Context) {
 	err = quizCollection.FindOne(context.TODO(), bson.M{"id": submission.QuizID}).Decode(&quiz)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Quiz not found"})
-		print("sdfsfdfsfdfsfsfdfsasdadadadasdsadasdsssssssssffd")
 		return
 	}
 
@@ -1906,9 +2300,9 @@ func submitQuiz(c *gin.Context) {
 	_, err = submissionCollection.UpdateOne(context.TODO(), filter, update, opts)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save submission"})
-		print("sdfsfdfsfdfsfsfdfsffd23232423")
 		return
 	}
+	quizSubmissions.WithLabelValues(submission.QuizID).Inc()
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Quiz submitted successfully",
@@ -1917,7 +2311,22 @@ func submitQuiz(c *gin.Context) {
 }
 
 func getStudentResults(c *gin.Context) {
-	email := c.Param("email")
+	quizResults(c, c.GetString("email"))
+}
+
+// getStudentResultsFor is the admin variant of getStudentResults for the
+// student in :email.
+func getStudentResultsFor(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	quizResults(c, user.Email)
+}
+
+func quizResults(c *gin.Context, email string) {
 	quizID := c.Param("quizid")
 
 	if email == "" || quizID == "" {
@@ -1990,9 +2399,85 @@ func getStudentResults(c *gin.Context) {
 	})
 }
 
+// sendQuizReminders queues an email to every student who has not submitted
+// a quiz yet.
+func sendQuizReminders(c *gin.Context) {
+	quizID := c.Param("quizid")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var quiz Quiz
+	if err := quizCollection.FindOne(ctx, bson.M{"id": quizID}).Decode(&quiz); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quiz not found"})
+		return
+	}
+	if time.Now().After(quiz.EndTime) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quiz has already ended"})
+		return
+	}
+
+	// Collect students who already submitted
+	submitted := map[string]bool{}
+	var submissionDoc struct {
+		Submissions []Submission `bson:"submissions"`
+	}
+	if err := submissionCollection.FindOne(ctx, bson.M{"quizId": quizID}).Decode(&submissionDoc); err == nil {
+		for _, sub := range submissionDoc.Submissions {
+			submitted[sub.StudentID] = true
+		}
+	}
+
+	cursor, err := userCollection.Find(ctx, bson.M{"role": "student"})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch students"})
+		return
+	}
+	var students []User
+	if err := cursor.All(ctx, &students); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse students"})
+		return
+	}
+
+	queued, failed := 0, 0
+	for _, student := range students {
+		if submitted[student.Email] {
+			continue
+		}
+		err := enqueueEmail(ctx, emailQuizReminder, gin.H{
+			"Username":  student.Username,
+			"QuizTitle": quiz.Title,
+			"EndTime":   quiz.EndTime,
+		}, student.Email)
+		if err != nil {
+			requestLog(c).Error("Quiz reminder not queued", "email", student.Email, "error", err)
+			failed++
+			continue
+		}
+		queued++
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Reminders queued", "queued": queued, "failed": failed})
+}
+
 func hasSubmitted(c *gin.Context) {
+	quizSubmitted(c, c.GetString("email"))
+}
+
+// hasSubmittedFor is the admin variant of hasSubmitted for the student in
+// :email.
+func hasSubmittedFor(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	quizSubmitted(c, user.Email)
+}
+
+func quizSubmitted(c *gin.Context, studentID string) {
 	quizID := c.Param("quizID")
-	studentID := c.Param("studentID")
 
 	// Look for the quiz submission document
 	var result struct {
@@ -2017,22 +2502,24 @@ func hasSubmitted(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"submitted": false})
 }
 func getusername1(c *gin.Context) {
-
-	email := c.Param("email")
-	if email == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"Username": "nil", "error": "Unauthorized: Invalid token data"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := currentUser(c, ctx)
+	if !ok {
 		return
 	}
-	// Check if the user exists in the database
-	var user User
+	c.JSON(http.StatusOK, gin.H{"username": user.Username})
+}
+
+// getusername1For is the admin variant of getusername1 for the user in
+// :email.
+func getusername1For(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	err := userCollection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"Username": "nil", "error": "Unauthorized: User not found"})
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
 		return
 	}
-	// Return success response
 	c.JSON(http.StatusOK, gin.H{"username": user.Username})
 }
 func getQuizLeaderboard(c *gin.Context) {
@@ -2105,36 +2592,47 @@ func deleteAssignment(c *gin.Context) {
 	courseName := c.Param("course")
 	assignmentName := c.Param("assignment")
 
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
 	// Delete assignment from DB
-	res, err := assignmentsCollection.DeleteOne(context.TODO(), bson.M{
+	var deleted bson.M
+	err := assignmentsCollection.FindOneAndDelete(ctx, bson.M{
 		"coursename":     courseName,
 		"assignmentname": assignmentName,
-	})
-	if err != nil || res.DeletedCount == 0 {
+	}).Decode(&deleted)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete assignment or not found"})
 		return
 	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditDeleteAssignment,
+		TargetType: auditTargetAssignment,
+		Target:     assignmentName,
+		Course:     courseName,
+		Before:     deleted,
+	})
 
 	// Delete assignment folder
-	assignmentDir := filepath.Join("uploads", "courses", courseName, "assignments", assignmentName)
+	assignmentDir := uploadPath("courses", courseName, "assignments", assignmentName)
 	if err := os.RemoveAll(assignmentDir); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete assignment directory"})
 		return
 	}
 
 	// ✅ Remove all student submissions related to this assignment
-	cursor, err := userCollection.Find(context.TODO(), bson.M{}) // You need to have a usersCollection
+	cursor, err := userCollection.Find(ctx, bson.M{}) // You need to have a usersCollection
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find students"})
 		return
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(ctx)
 
-	for cursor.Next(context.TODO()) {
+	for cursor.Next(ctx) {
 		var user bson.M
 		if err := cursor.Decode(&user); err == nil {
 			if studentName, ok := user["username"].(string); ok {
-				studentSubmissionDir := filepath.Join("uploads", "students", studentName, courseName, "assignments", assignmentName)
+				studentSubmissionDir := uploadPath("students", studentName, courseName, "assignments", assignmentName)
 				os.RemoveAll(studentSubmissionDir)
 			}
 		}
@@ -2144,22 +2642,40 @@ func deleteAssignment(c *gin.Context) {
 }
 func deleteCourse(c *gin.Context) {
 	courseName := c.Param("name")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
 	// Delete course from DB
-	res, err := coursesCollection.DeleteOne(context.TODO(), bson.M{"name": courseName})
-	if err != nil || res.DeletedCount == 0 {
+	var deleted bson.M
+	err := coursesCollection.FindOneAndDelete(ctx, bson.M{"name": courseName}).Decode(&deleted)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete course or course not found"})
 		return
 	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditDeleteCourse,
+		TargetType: auditTargetCourse,
+		Target:     courseName,
+		Course:     courseName,
+		Before:     deleted,
+	})
 
 	// Delete all assignments related to this course
-	_, err = assignmentsCollection.DeleteMany(context.TODO(), bson.M{"coursename": courseName})
+	_, err = assignmentsCollection.DeleteMany(ctx, bson.M{"coursename": courseName})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete course assignments"})
 		return
 	}
 
+	// Drop the course's instructor and TA assignments
+	_, err = courseStaffCollection.DeleteMany(ctx, bson.M{"course": courseName})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete course staff"})
+		return
+	}
+
 	// Delete course folder
-	courseDir := filepath.Join("uploads", "courses", courseName)
+	courseDir := uploadPath("courses", courseName)
 	if err := os.RemoveAll(courseDir); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete course directory"})
 		return
@@ -2169,48 +2685,112 @@ func deleteCourse(c *gin.Context) {
 }
 func ForgotPassword(c *gin.Context) {
 	var input struct {
-	Email       string `json:"email"`
-	NewPassword string `json:"newPassword"`
+		ResetToken  string `json:"resetToken"`
+		NewPassword string `json:"newPassword"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
+	if input.ResetToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reset token is required"})
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Find user to confirm they exist
-	var user User
-	err := userCollection.FindOne(ctx, bson.M{"email": input.Email}).Decode(&user)
+	// Check and hash the new password before spending the token
+	owner, err := resetTokenEmail(ctx, input.ResetToken)
 	if err != nil {
-		fmt.Println("User not found for reset:", err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		if err == errResetTokenInvalid {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired reset token"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify reset token"})
+		}
+		return
+	}
+	user, err := findUserByEmail(ctx, owner)
+	if err != nil && err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+	if !validatePassword(c, input.NewPassword, user.Username, owner) {
 		return
 	}
-
-	// Hash the new password
 	hashedPassword, err := HashPassword(input.NewPassword)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
 	}
 
+	// The token proves the OTP was verified and identifies the account
+	email, err := consumeResetToken(ctx, input.ResetToken)
+	if err != nil {
+		if err == errResetTokenInvalid {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired reset token"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify reset token"})
+		}
+		return
+	}
+
 	// Update password in DB
-	_, err = userCollection.UpdateOne(ctx,
-		bson.M{"email": input.Email},
-		bson.M{"$set": bson.M{"password": hashedPassword}},
+	result, err := userCollection.UpdateOne(ctx,
+		bson.M{"email": email},
+		bson.M{"$set": bson.M{"password": hashedPassword}, "$unset": bson.M{"password_reset_required": ""}},
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
 		return
 	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	// The token was delivered by email, so an invited account is now verified
+	if _, err := userCollection.UpdateOne(ctx,
+		bson.M{"email": email, "status": userStatusPendingVerification},
+		bson.M{"$set": bson.M{"status": userStatusActive}},
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify account"})
+		return
+	}
+
+	recordAudit(ctx, c, AuditEvent{
+		Actor:      email,
+		Action:     auditResetPassword,
+		TargetType: auditTargetUser,
+		Target:     email,
+	})
+
+	// Log out every device and script that used the old password
+	if _, err := revokeUserSessions(ctx, email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	if _, err := revokeUserAPITokens(ctx, email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API tokens"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Password reset successful"})
 }
 func main() {
-	router := gin.Default()
+	// SIGTERM (or Ctrl-C) starts a graceful shutdown, see serve
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := bootstrap(ctx)
+	if err != nil {
+		slog.Error("Startup failed", "error", err)
+		os.Exit(1)
+	}
+
+	router := gin.New()
+	router.Use(RequestID(), RequestLogger(append(probePaths, metricsPath)...), HTTPMetrics(), Recovery())
 	// router.Use(func(c *gin.Context) {
 	// 	c.Writer.Header().Set("Access-Control-Allow-Origin", "http://127.0.0.1:5500")
 	// 	c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
@@ -2225,53 +2805,126 @@ func main() {
 	// 	c.Next()
 	// })
 	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:3000", "http://localhost:5173"}, // Allow frontend origin
+		AllowOrigins:     config.CORSOrigins, // Allow frontend origin
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", requestIDHeader},
+		ExposeHeaders:    []string{requestIDHeader},
 		AllowCredentials: true,
 	}))
 	// Routes
-	router.StaticFS("/uploads", http.Dir("uploads"))
+	// Course material is public; photos and submissions are served below
+	// to the users allowed to see them
+	router.Static("/uploads/courses", uploadPath("courses"))
+	router.GET("/healthz", Healthz)
+	router.GET("/readyz", Readyz)
+	router.GET("/version", Version)
+	router.GET(metricsPath, Metrics)
+	router.GET("/password-policy", GetPasswordPolicy)
 	router.POST("/register", Register)
 	router.POST("/login", Login)
+	router.POST("/token/refresh", RefreshToken)
+	router.POST("/verify-email", VerifyEmail)
+	router.POST("/verify-email/resend", ResendVerificationEmail)
+	router.POST("/unlock-account", UnlockAccount)
+	router.POST("/login/2fa", LoginSecondFactor)
+	router.POST("/login/2fa/setup", LoginTwoFactorSetup)
+	router.POST("/login/2fa/setup/confirm", LoginTwoFactorConfirm)
+	router.GET("/auth/oidc/config", GetOIDCConfig)
+	router.GET("/auth/oidc/login", OIDCLogin)
+	router.GET("/auth/oidc/callback", OIDCCallback)
+	router.POST("/auth/oidc/exchange", OIDCExchange)
 	protected := router.Group("/")
 	protected.Use(AuthMiddleware())
 	protected.GET("/status", CheckLoginStatus)
+	protected.GET("/me/tokens", ListAPITokens)
+	protected.POST("/me/tokens", CreateAPIToken)
+	protected.DELETE("/me/tokens/:id", RevokeAPIToken)
+	protected.GET("/me/2fa", GetTwoFactorStatus)
+	protected.POST("/me/2fa/setup", SetupTwoFactor)
+	protected.POST("/me/2fa/confirm", ConfirmTwoFactor)
+	protected.POST("/me/2fa/disable", DisableTwoFactor)
+	protected.POST("/me/2fa/recovery-codes", RegenerateRecoveryCodes)
+	protected.GET("/me/sessions", ListMySessions)
+	protected.DELETE("/me/sessions/:id", RevokeMySession)
+	protected.POST("/me/sessions/revoke-others", RevokeOtherSessions)
+	protected.POST("/impersonation/stop", StopImpersonation)
 	router.POST("/request-otp1", RequestOTP1)
 	router.POST("/verify-otp1", VerifyOTP1)
-	router.POST("/add-details", AddUserDetails)
-	router.POST("/check-role", CheckUserRole)
-	router.PUT("/verify-payment/:email", VerifyPayment)
-	router.POST("/update-details", UpdateUserDetails)
-	router.GET("/students", GetAllStudents)
-	router.GET("/userdetails/:email", GetUserDetails)
-	router.POST("/logout", Logout)
-	router.GET("/userm", userm)
-	router.GET("/username", getusername)
-	router.GET("/username/email/:email", getusername1)
+	protected.POST("/add-details", AddUserDetails)
+	protected.POST("/check-role", CheckUserRole)
+	router.PUT("/verify-payment/:email", AuthMiddleware(), RequireRole(roleAdmin), VerifyPayment)
+	protected.POST("/update-details", UpdateUserDetails)
+	protected.GET("/me/details", GetUserDetails)
+	protected.GET("/me/photo", GetMyPhoto)
+	protected.GET("/uploads/students/:student/:course/assignments/:assignment/:file", GetSubmissionFile)
+	protected.POST("/logout", Logout)
+	protected.GET("/username", getusername)
+	protected.GET("/me/username", getusername1)
 	router.POST("/forgotpassword", ForgotPassword)
 
 	admin := router.Group("/admin")
+	admin.Use(AuthMiddleware(), RequireRole("admin"))
 	admin.POST("/course", createCourse)
-	admin.POST("/course/:course/resource", uploadResource)
-	// admin.POST("/courses/:course/uploadTextNote", uploadTextNote)
-	admin.POST("/courses/:course/uploadTextNote", uploadTextNote)
-	admin.POST("/courses/:course/assignments", createAssignment)
-	admin.GET("/courses/:course/assignments/:assignment/submissions", getSubmissions)
-	admin.POST("/courses/:course/assignments/:assignment/students/:student/grade", gradeAssignment)
+	admin.GET("/courses/:course/staff", GetCourseStaff)
+	admin.POST("/courses/:course/staff", AssignCourseStaff)
+	admin.DELETE("/courses/:course/staff/:email", RemoveCourseStaff)
+	admin.GET("/users", ListUsers)
+	admin.GET("/users/:email", GetUser)
+	admin.GET("/users/:email/role", CheckUserRoleFor)
+	admin.PUT("/users/:email/role", SetUserRole)
+	admin.GET("/users/:email/username", getusername1For)
+	admin.POST("/users/import", ImportRoster)
+	admin.POST("/users/:email/impersonate", StartImpersonation)
+	admin.GET("/impersonations", GetImpersonationEvents)
+	admin.GET("/audit-events", GetAuditEvents)
+	admin.GET("/audit-events/export", ExportAuditEvents)
+	admin.POST("/users/:email/deactivate", DeactivateUser)
+	admin.POST("/users/:email/reactivate", ReactivateUser)
+	admin.POST("/users/:email/force-password-reset", ForcePasswordReset)
+	admin.DELETE("/users/:email", DeleteUser)
+	admin.PUT("/users/:email/2fa-required", SetTwoFactorRequired)
+	admin.DELETE("/users/:email/2fa", ResetTwoFactor)
+	admin.GET("/users/:email/details", GetUserDetailsFor)
+	admin.GET("/users/:email/photo", GetUserPhoto)
+	admin.POST("/users/:email/details", UpdateUserDetailsFor)
+	admin.GET("/students", GetAllStudents)
 
 	admin.POST("/leaderboard/addpoint/:username", AddPoint)
 	admin.POST("/leaderboard/deletepoint/:username", DeletePoint)
 	admin.GET("/leaderboard", GetLeaderboard)
 	admin.GET("/leaderboard/search/:username", SearchStudent)
 	admin.DELETE("/deletecourse/:name", deleteCourse)
-	admin.DELETE("/course/:course/deleteassignment/:assignment", deleteAssignment)
-	admin.POST("/create-quiz", createQuiz)
 	admin.GET("/submissions", getAllquizSubmissions)
 	admin.GET("/student-progress/email/:email", getStudentProgress)
+	admin.GET("/results/email/:email/quizid/:quizid", getStudentResultsFor)
+	admin.GET("/checkquizSubmission/:quizID/:email", hasSubmittedFor)
+	admin.POST("/students/:email/courses/:course/assignments/:assignment/upload", uploadAssignmentFor)
+	admin.POST("/students/:email/courses/:course/assignments/:assignment/checksubmission", checkAssignmentSubmissionFor)
 	router.GET("/leaderboard/:quizid", getQuizLeaderboard)
 	admin.GET("/submissions/quiz/:quizid", getQuizSubmissionsByID)
 	admin.GET("/quizzes", getAllQuizzes)
+	admin.POST("/quizzes/:quizid/remind", sendQuizReminders)
+	admin.GET("/email/deliveries", GetEmailDeliveries)
+	admin.POST("/email/deliveries/:id/retry", RetryEmailDelivery)
+	admin.POST("/announcements", SendAnnouncement)
+	admin.GET("/users/:email/sessions", GetUserSessions)
+	admin.DELETE("/users/:email/sessions/:id", RevokeUserSession)
+	admin.POST("/users/:email/revoke-sessions", RevokeUserSessions)
+	admin.POST("/users/:email/verify", AdminVerifyUser)
+	admin.GET("/lockouts", GetLoginLockouts)
+	admin.DELETE("/lockouts", ClearLoginLockout)
+
+	// Course routes open to the course's instructors and TAs as well as admins
+	staff := router.Group("/admin")
+	staff.Use(AuthMiddleware())
+	staff.POST("/course/:course/resource", RequireCoursePermission(permContentWrite), uploadResource)
+	// staff.POST("/courses/:course/uploadTextNote", uploadTextNote)
+	staff.POST("/courses/:course/uploadTextNote", RequireCoursePermission(permContentWrite), uploadTextNote)
+	staff.POST("/courses/:course/assignments", RequireCoursePermission(permContentWrite), createAssignment)
+	staff.GET("/courses/:course/assignments/:assignment/submissions", RequireCoursePermission(permSubmissionsRead), getSubmissions)
+	staff.POST("/courses/:course/assignments/:assignment/students/:student/grade", RequireCoursePermission(permGradesWrite), gradeAssignment)
+	staff.DELETE("/course/:course/deleteassignment/:assignment", RequireCoursePermission(permContentDelete), deleteAssignment)
+	staff.POST("/create-quiz", RequireRole(roleAdmin, roleInstructor), createQuiz)
 
 	// Student routes
 	router.GET("/courses", getCourses)
@@ -2279,21 +2932,24 @@ func main() {
 	router.GET("/course/:course/resource/:resource", downloadResource)
 	// router.GET("/courses/:course/downloadNotes", downloadNotes)
 	router.GET("/courses/:course/downloadNotes/:note", downloadNotes)
-	router.POST("/students/:student/courses/:course/assignments/:assignment/upload", uploadAssignment)
-	router.POST("/students/:student/courses/:course/assignments/:assignment/checksubmission", checkAssignmentSubmission)
+	protected.POST("/courses/:course/assignments/:assignment/upload", uploadAssignment)
+	protected.POST("/courses/:course/assignments/:assignment/checksubmission", checkAssignmentSubmission)
 	router.GET("/students/courses/:course/assignments", getStudentAssignments) // **View Assignments**
 	router.GET("/leaderboard", GetStudentLeaderboard)
 
 	router.GET("/active-quizzes", getActiveQuizzes)
-	router.POST("/submit-quiz", submitQuiz)
-	router.GET("/results/email/:email/quizid/:quizid", getStudentResults)
-	router.GET("/checkquizSubmission/:quizID/:studentID", hasSubmitted)
+	protected.POST("/submit-quiz", submitQuiz)
+	protected.GET("/results/quizid/:quizid", getStudentResults)
+	protected.GET("/checkquizSubmission/:quizID", hasSubmitted)
+	protected.GET("/student-progress", getMyProgress)
 
 	router.GET("/courses/summary", GetCourseNamesAndCount)
 	router.GET("/assignments", GetAssignmentSummary)
 	router.GET("/leaderboard/me", AuthMiddleware(), GetCurrentUserStats)
-	
-	fmt.Println("Server running on port 8000")
-	router.Run(":8000")
 
+	if err := serve(ctx, router, client); err != nil {
+		slog.Error("Server failed", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Server stopped")
 }
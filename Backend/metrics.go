@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// The metrics below are exposed at /metrics, next to the Go runtime and
+// process metrics of the default registry. They are kept in process, so
+// with several replicas each is scraped on its own.
+var (
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lms_http_request_duration_seconds",
+		Help:    "Time taken to answer HTTP requests, by route and status. Its _count is the number of requests.",
+		Buckets: latencyBuckets,
+	}, []string{"method", "route", "status"})
+	httpInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "lms_http_requests_in_flight",
+		Help: "HTTP requests being handled.",
+	})
+	mongoCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lms_mongo_command_duration_seconds",
+		Help:    "Time taken by MongoDB commands, by collection and command.",
+		Buckets: latencyBuckets,
+	}, []string{"collection", "command"})
+	mongoCommandFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lms_mongo_command_failures_total",
+		Help: "MongoDB commands that returned an error, by collection and command.",
+	}, []string{"collection", "command"})
+	uploadSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lms_upload_size_bytes",
+		Help:    "Size of uploaded files, by kind. Its _sum is the total bytes received.",
+		Buckets: []float64{1 << 10, 10 << 10, 100 << 10, 512 << 10, 1 << 20, 5 << 20, 10 << 20, 50 << 20},
+	}, []string{"kind"})
+	uploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lms_upload_duration_seconds",
+		Help:    "Time from the start of an upload request until the file is stored, by kind.",
+		Buckets: latencyBuckets,
+	}, []string{"kind"})
+	quizSubmissions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lms_quiz_submissions_total",
+		Help: "Quiz submissions saved, by quiz.",
+	}, []string{"quiz"})
+	otpEmails = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lms_otp_emails_total",
+		Help: "Delivery attempts of emails carrying a one-time code, by template and result (success or failure).",
+	}, []string{"template", "result"})
+)
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// otpTemplates are the emails whose delivery counts towards otpEmails.
+var otpTemplates = map[string]bool{
+	emailOTP:           true,
+	emailPasswordReset: true,
+	emailVerifyEmail:   true,
+	emailAccountLocked: true,
+}
+
+// Upload kinds.
+const (
+	uploadKindPhoto         = "photo"
+	uploadKindResource      = "resource"
+	uploadKindAssignmentPDF = "assignment_pdf"
+	uploadKindSubmission    = "submission"
+)
+
+const metricsPath = "/metrics"
+
+// metricsToken, when set through METRICS_TOKEN, must be sent as a bearer
+// token to read /metrics.
+var metricsToken string
+
+var metricsHandler = promhttp.Handler()
+
+// initMetrics reads the metrics settings and registers the gauges that
+// read from MongoDB, which needs the collections to be set up.
+func initMetrics() error {
+	metricsToken = os.Getenv("METRICS_TOKEN")
+	return prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "lms_active_sessions",
+		Help: "Login sessions that are neither revoked nor expired.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		count, err := activeSessions(ctx)
+		if err != nil {
+			// NaN rather than a wrong value
+			slog.Warn("Failed to count active sessions for metrics", "error", err)
+			return math.NaN()
+		}
+		return float64(count)
+	}))
+}
+
+// HTTPMetrics times every request. It also records when the request
+// started as "request_start", which observeUpload measures from.
+func HTTPMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Set("request_start", start)
+		httpInFlight.Inc()
+		c.Next()
+		httpInFlight.Dec()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeUpload records a stored upload of size bytes.
+func observeUpload(c *gin.Context, kind string, size int64) {
+	uploadSize.WithLabelValues(kind).Observe(float64(size))
+	if start := c.GetTime("request_start"); !start.IsZero() {
+		uploadDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+	}
+}
+
+// mongoMetricsMonitor times every MongoDB command that works on a
+// collection. Commands such as ping and hello are left out.
+func mongoMetricsMonitor() *event.CommandMonitor {
+	type command struct{ collection, name string }
+	var started sync.Map // request ID to command
+	finish := func(requestID int64, duration time.Duration, failed bool) {
+		v, ok := started.LoadAndDelete(requestID)
+		if !ok {
+			return
+		}
+		cmd := v.(command)
+		mongoCommandDuration.WithLabelValues(cmd.collection, cmd.name).Observe(duration.Seconds())
+		if failed {
+			mongoCommandFailures.WithLabelValues(cmd.collection, cmd.name).Inc()
+		}
+	}
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, e *event.CommandStartedEvent) {
+			// The collection is the value of the command's first field,
+			// except for getMore which names it separately
+			field := e.CommandName
+			if field == "getMore" {
+				field = "collection"
+			}
+			collection, ok := e.Command.Lookup(field).StringValueOK()
+			if !ok || collection == "" {
+				return
+			}
+			started.Store(e.RequestID, command{collection, e.CommandName})
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			finish(e.RequestID, e.Duration, false)
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			finish(e.RequestID, e.Duration, true)
+		},
+	}
+}
+
+// activeSessions counts the login sessions that are neither revoked nor
+// expired.
+func activeSessions(ctx context.Context) (int64, error) {
+	return sessionCollection.CountDocuments(ctx, bson.M{
+		"revoked_at": nil,
+		"expires_at": bson.M{"$gt": time.Now()},
+	})
+}
+
+// Metrics serves every metric in the Prometheus exposition format.
+func Metrics(c *gin.Context) {
+	if metricsToken != "" {
+		presented := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(metricsToken)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid metrics token"})
+			return
+		}
+	}
+	metricsHandler.ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,32 @@
+// Command mockidp is a minimal OpenID Connect provider for trying out and
+// testing single sign-on locally. It signs ID tokens with a key generated at
+// startup and lets you sign in as any email address, so never expose it.
+//
+//	go run ./mockidp -addr :9000 -client-id lms -client-secret secret
+//
+// then start the backend with OIDC_ISSUER=http://localhost:9000,
+// OIDC_CLIENT_ID=lms and OIDC_CLIENT_SECRET=secret.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"Learning-Management-System/mockidp/idp"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "listen address")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer URL, as the backend reaches it")
+	clientID := flag.String("client-id", "lms", "accepted client ID")
+	clientSecret := flag.String("client-secret", "secret", "accepted client secret")
+	flag.Parse()
+
+	p, err := idp.New(*issuer, *clientID, *clientSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Mock identity provider %s listening on %s", *issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, p.Handler()))
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OIDCConfig configures single sign-on with an OpenID Connect identity
+// provider using the authorization code flow with PKCE. SSO is off unless
+// OIDC_ISSUER is set.
+type OIDCConfig struct {
+	Issuer         string
+	ClientID       string
+	ClientSecret   string
+	RedirectURL    string   // this backend's /auth/oidc/callback as registered with the IdP
+	FrontendURL    string   // where the browser is sent back to once the IdP is done
+	Scopes         []string // requested scopes, always including openid
+	AllowedDomains []string // email domains that may sign in, any if empty
+}
+
+// OIDCState remembers an authorization request until the IdP redirects back.
+type OIDCState struct {
+	StateHash    string    `bson:"state_hash"`
+	Nonce        string    `bson:"nonce"`
+	CodeVerifier string    `bson:"code_verifier"`
+	ExpiresAt    time.Time `bson:"expires_at"`
+}
+
+// oidcProvider is the part of the IdP's discovery document we use.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+var (
+	oidcConfig          *OIDCConfig
+	oidcStateCollection *mongo.Collection
+)
+
+const (
+	oidcStateTTL       = 10 * time.Minute
+	oidcKeyRefreshWait = time.Minute
+)
+
+// oidcStateCookie ties an authorization request to the browser that started
+// it. Without it, an attacker could send a victim to the callback with the
+// attacker's own code and state, signing the victim into the attacker's
+// account. It holds the hash of the state and is only sent to /auth/oidc.
+const (
+	oidcStateCookie     = "oidc_state"
+	oidcStateCookiePath = "/auth/oidc"
+)
+
+var (
+	errOIDCDomainNotAllowed = errors.New("email domain not allowed")
+	errOIDCEmailUnverified  = errors.New("identity provider has not verified the email")
+)
+
+// oidcHTTPClient talks to the IdP. Requests are made while the user waits,
+// so they must not hang.
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// Discovery and signing keys are fetched on first use and cached, so the
+// backend starts even when the IdP is briefly unreachable.
+var oidcCache struct {
+	sync.Mutex
+	provider      *oidcProvider
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+// NewOIDCConfigFromEnv reads OIDC_ISSUER, OIDC_CLIENT_ID,
+// OIDC_CLIENT_SECRET, OIDC_REDIRECT_URL, OIDC_FRONTEND_URL, OIDC_SCOPES and
+// OIDC_ALLOWED_DOMAINS. It returns nil when SSO is not configured.
+func NewOIDCConfigFromEnv() (*OIDCConfig, error) {
+	issuer := strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	cfg := &OIDCConfig{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		FrontendURL:  os.Getenv("OIDC_FRONTEND_URL"),
+		Scopes:       []string{"openid", "email", "profile"},
+	}
+	if cfg.ClientID == "" {
+		return nil, errors.New("OIDC_CLIENT_ID is required when OIDC_ISSUER is set")
+	}
+	if cfg.RedirectURL == "" {
+		cfg.RedirectURL = "http://localhost:8000/auth/oidc/callback"
+	}
+	if cfg.FrontendURL == "" {
+		cfg.FrontendURL = "http://localhost:5173/login"
+	}
+	for _, raw := range []string{cfg.Issuer, cfg.RedirectURL, cfg.FrontendURL} {
+		if u, err := url.Parse(raw); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid OIDC URL %q", raw)
+		}
+	}
+	if raw := os.Getenv("OIDC_SCOPES"); raw != "" {
+		cfg.Scopes = []string{"openid"}
+		for _, scope := range strings.Fields(strings.ReplaceAll(raw, ",", " ")) {
+			if scope != "openid" {
+				cfg.Scopes = append(cfg.Scopes, scope)
+			}
+		}
+	}
+	for _, domain := range strings.Split(os.Getenv("OIDC_ALLOWED_DOMAINS"), ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			cfg.AllowedDomains = append(cfg.AllowedDomains, strings.TrimPrefix(domain, "@"))
+		}
+	}
+	return cfg, nil
+}
+
+// initOIDC creates the oidc_states indexes.
+func initOIDC(ctx context.Context) error {
+	_, err := oidcStateCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "state_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+func randomURLSafe(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func fetchJSON(ctx context.Context, rawURL string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// loadOIDCProvider returns the IdP's endpoints from its discovery document.
+func loadOIDCProvider(ctx context.Context) (*oidcProvider, error) {
+	oidcCache.Lock()
+	defer oidcCache.Unlock()
+	if oidcCache.provider != nil {
+		return oidcCache.provider, nil
+	}
+	var provider oidcProvider
+	if err := fetchJSON(ctx, oidcConfig.Issuer+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != oidcConfig.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, expected %q", provider.Issuer, oidcConfig.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	oidcCache.provider = &provider
+	return &provider, nil
+}
+
+// oidcSigningKey returns the IdP's RSA key with the given ID. The key set is
+// refetched when an unknown key shows up, which is how IdPs rotate keys, but
+// not more than once a minute.
+func oidcSigningKey(ctx context.Context, provider *oidcProvider, kid string) (*rsa.PublicKey, error) {
+	oidcCache.Lock()
+	defer oidcCache.Unlock()
+	if key, ok := oidcCache.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(oidcCache.keysFetchedAt) < oidcKeyRefreshWait {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	oidcCache.keysFetchedAt = time.Now()
+	if err := fetchJSON(ctx, provider.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	oidcCache.keys = keys
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// exchangeOIDCCode trades an authorization code for the ID token.
+func exchangeOIDCCode(ctx context.Context, provider *oidcProvider, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcConfig.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(oidcConfig.ClientID), url.QueryEscape(oidcConfig.ClientSecret))
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: %s %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, expiry
+// and nonce, and returns its claims.
+func verifyIDToken(ctx context.Context, provider *oidcProvider, idToken, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return oidcSigningKey(ctx, provider, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != oidcConfig.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	audienceOK := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audienceOK = aud == oidcConfig.ClientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == oidcConfig.ClientID {
+				audienceOK = true
+			}
+		}
+	}
+	if !audienceOK {
+		return nil, errors.New("token is not for this client")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	return claims, nil
+}
+
+// oidcEmail extracts the email claim and checks it may sign in. verified
+// is only true if the IdP states it checked the address; some providers
+// leave the claim out, which is accepted for new accounts only.
+func oidcEmail(claims jwt.MapClaims) (email string, verified bool, err error) {
+	raw, _ := claims["email"].(string)
+	email, ok := normalizeEmail(raw)
+	if !ok {
+		return "", false, errors.New("token has no valid email claim")
+	}
+	// A few providers send the claim as a string
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		verified = v
+	case string:
+		verified = v == "true"
+	}
+	if _, present := claims["email_verified"]; present && !verified {
+		return "", false, errOIDCEmailUnverified
+	}
+	if len(oidcConfig.AllowedDomains) > 0 {
+		domain := email[strings.LastIndex(email, "@")+1:]
+		allowed := false
+		for _, d := range oidcConfig.AllowedDomains {
+			if domain == d {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return "", false, errOIDCDomainNotAllowed
+		}
+	}
+	return email, verified, nil
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// provisionOIDCUser finds the user for an SSO email or creates a student
+// account for it, with a leaderboard entry like Register. SSO users get a
+// random password they can replace through the reset flow. An existing
+// account is only signed into when the IdP verified the email, as anyone
+// able to set that address at the IdP would otherwise take it over.
+func provisionOIDCUser(ctx context.Context, email string, verified bool) (User, error) {
+	user, err := findUserByEmail(ctx, email)
+	if err == nil {
+		if !verified {
+			return user, errOIDCEmailUnverified
+		}
+		// The IdP vouches for the address
+		if user.Status == userStatusPendingVerification {
+			_, err = userCollection.UpdateOne(ctx, bson.M{"email": user.Email}, bson.M{"$set": bson.M{"status": userStatusActive}})
+			user.Status = userStatusActive
+		}
+		return user, err
+	}
+	if err != mongo.ErrNoDocuments {
+		return user, err
+	}
+
+	secret, err := randomURLSafe(32)
+	if err != nil {
+		return user, err
+	}
+	hashedPassword, err := HashPassword(secret)
+	if err != nil {
+		return user, err
+	}
+	base := usernameUnsafe.ReplaceAllString(email[:strings.LastIndex(email, "@")], "")
+	if base == "" || base == "." || base == ".." {
+		base = "student"
+	}
+	for i := 0; i < 10; i++ {
+		username := base
+		if i > 0 {
+			suffix, _ := randomURLSafe(3)
+			username = base + "-" + strings.ToLower(usernameUnsafe.ReplaceAllString(suffix, ""))
+		}
+		user = User{
+			Username: username,
+			Email:    email,
+			Password: hashedPassword,
+			Role:     roleStudent,
+			Status:   userStatusActive,
+		}
+		_, err = userCollection.InsertOne(ctx, user)
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return user, err
+		}
+		// Either the username is taken or the same person signed in twice at once
+		if existing, findErr := findUserByEmail(ctx, email); findErr == nil {
+			return existing, nil
+		}
+	}
+	if err != nil {
+		return user, err
+	}
+	if _, err := leaderboardCollection.InsertOne(ctx, bson.M{"username": user.Username, "points": 0}); err != nil {
+		return user, err
+	}
+	slog.Info("Provisioned SSO account", "username", user.Username, "email", email)
+	return user, nil
+}
+
+// setOIDCStateCookie stores value in the state cookie for maxAge seconds; a
+// negative maxAge deletes it. The cookie is Secure when the callback is
+// served over HTTPS.
+func setOIDCStateCookie(c *gin.Context, value string, maxAge int) {
+	secure := strings.HasPrefix(oidcConfig.RedirectURL, "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, value, maxAge, oidcStateCookiePath, "", secure, true)
+}
+
+// redirectToFrontend sends the browser back to the frontend with the result
+// in the URL fragment, which is never sent to a server.
+func redirectToFrontend(c *gin.Context, params url.Values) {
+	c.Redirect(http.StatusFound, oidcConfig.FrontendURL+"#"+params.Encode())
+}
+
+// GetOIDCConfig tells the frontend whether to offer SSO.
+func GetOIDCConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"enabled": oidcConfig != nil})
+}
+
+// OIDCLogin redirects the browser to the IdP.
+func OIDCLogin(c *gin.Context) {
+	if oidcConfig == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	provider, err := loadOIDCProvider(ctx)
+	if err != nil {
+		requestLog(c).Error("OIDC discovery failed", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+	state, err1 := randomURLSafe(32)
+	nonce, err2 := randomURLSafe(32)
+	verifier, err3 := randomURLSafe(32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start single sign-on"})
+		return
+	}
+	_, err = oidcStateCollection.InsertOne(ctx, OIDCState{
+		StateHash:    hashToken(state),
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start single sign-on"})
+		return
+	}
+	setOIDCStateCookie(c, hashToken(state), int(oidcStateTTL/time.Second))
+	c.Redirect(http.StatusFound, oidcAuthorizeURL(provider, state, nonce, verifier))
+}
+
+// oidcAuthorizeURL is where OIDCLogin sends the browser to sign in.
+func oidcAuthorizeURL(provider *oidcProvider, state, nonce, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcConfig.ClientID},
+		"redirect_uri":          {oidcConfig.RedirectURL},
+		"scope":                 {strings.Join(oidcConfig.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + params.Encode()
+}
+
+// oidcSignIn redeems the authorization code of the request in state,
+// checks the ID token it yields and returns the email it vouches for, as
+// oidcEmail does.
+func oidcSignIn(ctx context.Context, provider *oidcProvider, code string, state OIDCState) (email string, verified bool, err error) {
+	idToken, err := exchangeOIDCCode(ctx, provider, code, state.CodeVerifier)
+	if err != nil {
+		return "", false, fmt.Errorf("code exchange: %w", err)
+	}
+	claims, err := verifyIDToken(ctx, provider, idToken, state.Nonce)
+	if err != nil {
+		return "", false, fmt.Errorf("ID token rejected: %w", err)
+	}
+	return oidcEmail(claims)
+}
+
+// OIDCCallback handles the IdP's redirect. On success the browser goes back
+// to the frontend with a login challenge, which it exchanges for tokens
+// through OIDCExchange; errors are passed back the same way.
+func OIDCCallback(c *gin.Context) {
+	if oidcConfig == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+	fail := func(message string) {
+		redirectToFrontend(c, url.Values{"ssoError": {message}})
+	}
+	if idpError := c.Query("error"); idpError != "" {
+		requestLog(c).Warn("OIDC login refused by identity provider", "error", idpError, "description", c.Query("error_description"))
+		fail("Sign-in was cancelled or refused")
+		return
+	}
+
+	// The state must come back to the browser that started the sign-in
+	stateHash := hashToken(c.Query("state"))
+	cookie, _ := c.Cookie(oidcStateCookie)
+	setOIDCStateCookie(c, "", -1)
+	if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(stateHash)) != 1 {
+		requestLog(c).Warn("OIDC callback state does not match the browser's")
+		fail("Sign-in expired, please try again")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var state OIDCState
+	err := oidcStateCollection.FindOneAndDelete(ctx, bson.M{
+		"state_hash": stateHash,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&state)
+	if err != nil {
+		fail("Sign-in expired, please try again")
+		return
+	}
+	provider, err := loadOIDCProvider(ctx)
+	if err != nil {
+		requestLog(c).Error("OIDC discovery failed", "error", err)
+		fail("Identity provider unavailable")
+		return
+	}
+	email, verified, err := oidcSignIn(ctx, provider, c.Query("code"), state)
+	if err != nil {
+		switch err {
+		case errOIDCDomainNotAllowed:
+			fail("Your email domain is not allowed to sign in")
+		case errOIDCEmailUnverified:
+			fail("Your email address is not verified with your identity provider")
+		default:
+			requestLog(c).Warn("OIDC sign-in failed", "error", err)
+			fail("Sign-in failed, please try again")
+		}
+		return
+	}
+	user, err := provisionOIDCUser(ctx, email, verified)
+	if err == errOIDCEmailUnverified {
+		fail("Your email address is not verified with your identity provider")
+		return
+	}
+	if err != nil {
+		requestLog(c).Error("OIDC account provisioning failed", "email", email, "error", err)
+		fail("Failed to set up your account")
+		return
+	}
+	if user.DeactivatedAt != nil {
+		fail("Account deactivated")
+		return
+	}
+	challenge, err := startLoginChallenge(ctx, user.Email)
+	if err != nil {
+		fail("Sign-in failed, please try again")
+		return
+	}
+	redirectToFrontend(c, url.Values{"sso": {challenge}, "email": {user.Email}})
+}
+
+// OIDCExchange turns the challenge from OIDCCallback into tokens, or asks
+// for the second factor exactly like Login when the user has 2FA.
+func OIDCExchange(c *gin.Context) {
+	var input struct {
+		ChallengeToken string `json:"challengeToken"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.ChallengeToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadChallengeUser(c, ctx, input.ChallengeToken)
+	if !ok {
+		return
+	}
+	if user.DeactivatedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account deactivated"})
+		return
+	}
+	tf, err := loadTwoFactor(ctx, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor settings"})
+		return
+	}
+	enrolled := tf != nil && tf.Enabled
+	if enrolled || twoFactorRequired(user) {
+		// The same challenge carries on to /login/2fa
+		c.JSON(http.StatusOK, gin.H{
+			"message":                "Two-factor authentication required",
+			"twoFactorRequired":      true,
+			"twoFactorSetupRequired": !enrolled,
+			"challengeToken":         input.ChallengeToken,
+		})
+		return
+	}
+	endLoginChallenge(ctx, input.ChallengeToken)
+
+	response, ok := startLoginSession(c, ctx, user.Email)
+	if !ok {
+		return
+	}
+	response["email"] = user.Email
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"Learning-Management-System/mockidp/idp"
+)
+
+// resetOIDCCache forgets the discovery document and signing keys.
+func resetOIDCCache() {
+	oidcCache.Lock()
+	defer oidcCache.Unlock()
+	oidcCache.provider = nil
+	oidcCache.keys = nil
+	oidcCache.keysFetchedAt = time.Time{}
+}
+
+// setTestOIDCConfig points single sign-on at issuer for the test.
+func setTestOIDCConfig(t *testing.T, issuer string) {
+	t.Helper()
+	saved := oidcConfig
+	oidcConfig = &OIDCConfig{
+		Issuer:       issuer,
+		ClientID:     "lms",
+		ClientSecret: "secret",
+		RedirectURL:  "https://lms.example.com/auth/oidc/callback",
+		FrontendURL:  "https://lms.example.com/login",
+		Scopes:       []string{"openid", "email"},
+	}
+	resetOIDCCache()
+	t.Cleanup(func() {
+		oidcConfig = saved
+		resetOIDCCache()
+	})
+}
+
+// startMockIdP runs the mock identity provider, configures SSO with it and
+// returns its endpoints as found through discovery.
+func startMockIdP(t *testing.T) *oidcProvider {
+	t.Helper()
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	p, err := idp.New(server.URL, "lms", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler = p.Handler()
+
+	setTestOIDCConfig(t, server.URL)
+	provider, err := loadOIDCProvider(context.Background())
+	if err != nil {
+		t.Fatalf("discovery: %v", err)
+	}
+	return provider
+}
+
+// newTestOIDCState starts an authorization request like OIDCLogin does.
+func newTestOIDCState(t *testing.T) (string, OIDCState) {
+	t.Helper()
+	state, err1 := randomURLSafe(32)
+	nonce, err2 := randomURLSafe(32)
+	verifier, err3 := randomURLSafe(32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		t.Fatal("randomURLSafe failed")
+	}
+	return state, OIDCState{StateHash: hashToken(state), Nonce: nonce, CodeVerifier: verifier}
+}
+
+// authorizeAtMockIdP signs in at the authorization endpoint the way a
+// browser would and returns the code and state it redirects back with.
+// form is what the login page is submitted with; nil signs in through
+// login_hint instead.
+func authorizeAtMockIdP(t *testing.T, authorizeURL, email string, form url.Values) (code, state string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	var resp *http.Response
+	var err error
+	if form == nil {
+		resp, err = client.Get(authorizeURL + "&login_hint=" + url.QueryEscape(email))
+	} else {
+		resp, err = client.PostForm(authorizeURL, form)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: %s, want a redirect", resp.Status)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callback := location.Scheme + "://" + location.Host + location.Path; callback != oidcConfig.RedirectURL {
+		t.Fatalf("redirected to %s, want %s", callback, oidcConfig.RedirectURL)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+// errAny stands for any error in the table below.
+var errAny = errors.New("any error")
+
+func TestOIDCSignInWithMockIdP(t *testing.T) {
+	provider := startMockIdP(t)
+
+	tests := []struct {
+		name           string
+		email          string
+		form           url.Values // login page submission, nil for login_hint
+		allowedDomains []string
+		tamper         func(*OIDCState)
+		wantEmail      string
+		wantVerified   bool
+		wantErr        error // a specific error, or errAny
+	}{
+		{name: "verified email", email: "Student@School.edu", wantEmail: "student@school.edu", wantVerified: true},
+		{name: "allowed domain", email: "student@school.edu", allowedDomains: []string{"school.edu"}, wantEmail: "student@school.edu", wantVerified: true},
+		{name: "disallowed domain", email: "student@gmail.com", allowedDomains: []string{"school.edu"}, wantErr: errOIDCDomainNotAllowed},
+		{name: "unverified email", form: url.Values{"email": {"student@school.edu"}}, wantErr: errOIDCEmailUnverified},
+		{name: "nonce mismatch", email: "student@school.edu", tamper: func(s *OIDCState) { s.Nonce = "another-nonce" }, wantErr: errAny},
+		{name: "wrong PKCE verifier", email: "student@school.edu", tamper: func(s *OIDCState) { s.CodeVerifier = "another-verifier" }, wantErr: errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oidcConfig.AllowedDomains = tt.allowedDomains
+			state, stored := newTestOIDCState(t)
+			code, returnedState := authorizeAtMockIdP(t, oidcAuthorizeURL(provider, state, stored.Nonce, stored.CodeVerifier), tt.email, tt.form)
+			if returnedState != state {
+				t.Fatalf("state = %q, want %q", returnedState, state)
+			}
+			if tt.tamper != nil {
+				tt.tamper(&stored)
+			}
+
+			email, verified, err := oidcSignIn(context.Background(), provider, code, stored)
+			switch {
+			case tt.wantErr == errAny:
+				if err == nil {
+					t.Fatalf("oidcSignIn() = %q, want an error", email)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("oidcSignIn() error = %v, want %v", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("oidcSignIn() = %v", err)
+			default:
+				if email != tt.wantEmail || verified != tt.wantVerified {
+					t.Errorf("oidcSignIn() = %q, %v, want %q, %v", email, verified, tt.wantEmail, tt.wantVerified)
+				}
+			}
+		})
+	}
+}
+
+func TestOIDCSignInCodeUsedOnce(t *testing.T) {
+	provider := startMockIdP(t)
+	state, stored := newTestOIDCState(t)
+	code, _ := authorizeAtMockIdP(t, oidcAuthorizeURL(provider, state, stored.Nonce, stored.CodeVerifier), "student@school.edu", nil)
+	if _, _, err := oidcSignIn(context.Background(), provider, code, stored); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if _, _, err := oidcSignIn(context.Background(), provider, code, stored); err == nil {
+		t.Error("the code was accepted twice")
+	}
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	setTestOIDCConfig(t, "https://idp.example.com")
+	tests := []struct {
+		name   string
+		cookie string
+	}{
+		{"no cookie", ""},
+		{"cookie of another sign-in", hashToken("another-state")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?code=stolen&state=attacker-state", nil)
+			if tt.cookie != "" {
+				c.Request.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: tt.cookie})
+			}
+			// Refused before the state store is consulted, so no database is needed
+			OIDCCallback(c)
+
+			location := w.Header().Get("Location")
+			if w.Code != http.StatusFound || !strings.HasPrefix(location, oidcConfig.FrontendURL+"#") {
+				t.Fatalf("OIDCCallback() = %d to %q, want a redirect to the frontend", w.Code, location)
+			}
+			fragment, _ := url.ParseQuery(location[strings.Index(location, "#")+1:])
+			if fragment.Get("ssoError") == "" || fragment.Get("sso") != "" {
+				t.Errorf("fragment = %v, want only an ssoError", fragment)
+			}
+		})
+	}
+}
+
+func TestOIDCStateCookie(t *testing.T) {
+	setTestOIDCConfig(t, "https://idp.example.com")
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	setOIDCStateCookie(c, hashToken("state"), int(oidcStateTTL/time.Second))
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+	cookie := cookies[0]
+	if cookie.Name != oidcStateCookie || cookie.Value != hashToken("state") {
+		t.Errorf("cookie = %s=%s", cookie.Name, cookie.Value)
+	}
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != oidcStateCookiePath {
+		t.Errorf("cookie attributes = HttpOnly %v, Secure %v, SameSite %v, Path %q", cookie.HttpOnly, cookie.Secure, cookie.SameSite, cookie.Path)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// OTPRecord is a one-time code waiting to be verified. Only a bcrypt hash of
+// the code is stored, and MongoDB deletes the record once it expires, so
+// every backend replica sees the same state.
+type OTPRecord struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Email     string             `bson:"email"`
+	Purpose   string             `bson:"purpose"`
+	CodeHash  string             `bson:"code_hash"`
+	Attempts  int                `bson:"attempts"`
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+// OTP purposes. A code issued for one purpose cannot be used for another.
+const (
+	otpPurposeGeneral       = "general"
+	otpPurposeResetPassword = "reset_password"
+	otpPurposeVerifyEmail   = "verify_email"
+	otpPurposeUnlockAccount = "unlock_account"
+)
+
+// parseOTPPurpose maps the purpose sent by the client to a purpose it may
+// request through RequestOTP1; an empty value means otpPurposeGeneral.
+func parseOTPPurpose(purpose string) (string, bool) {
+	switch purpose {
+	case "", otpPurposeGeneral:
+		return otpPurposeGeneral, true
+	case otpPurposeResetPassword:
+		return otpPurposeResetPassword, true
+	}
+	return "", false
+}
+
+var otpCollection *mongo.Collection
+
+// OTP settings, overridable through OTP_TTL, OTP_MAX_ATTEMPTS and
+// OTP_RESEND_COOLDOWN.
+var (
+	otpTTL            = 10 * time.Minute
+	otpMaxAttempts    = 5
+	otpResendCooldown = time.Minute
+)
+
+var (
+	errOTPCooldown        = errors.New("otp requested too recently")
+	errOTPInvalid         = errors.New("invalid otp")
+	errOTPExpired         = errors.New("otp expired or not found")
+	errOTPTooManyAttempts = errors.New("too many otp attempts")
+)
+
+// initOTPStore reads the OTP settings and creates the otps indexes: one code
+// per email and purpose, removed by MongoDB when it expires.
+func initOTPStore(ctx context.Context) error {
+	if err := loadOTPSettings(); err != nil {
+		return err
+	}
+	_, err := otpCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "purpose", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// loadOTPSettings reads OTP_TTL, OTP_MAX_ATTEMPTS and OTP_RESEND_COOLDOWN.
+func loadOTPSettings() error {
+	if raw := os.Getenv("OTP_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid OTP_TTL %q", raw)
+		}
+		otpTTL = ttl
+	}
+	if raw := os.Getenv("OTP_MAX_ATTEMPTS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid OTP_MAX_ATTEMPTS %q", raw)
+		}
+		otpMaxAttempts = n
+	}
+	if raw := os.Getenv("OTP_RESEND_COOLDOWN"); raw != "" {
+		cooldown, err := time.ParseDuration(raw)
+		if err != nil || cooldown < 0 {
+			return fmt.Errorf("invalid OTP_RESEND_COOLDOWN %q", raw)
+		}
+		otpResendCooldown = cooldown
+	}
+	return nil
+}
+
+// otpReplaceableBefore returns the creation time at or before which a code
+// may be replaced by a new one, enforcing otpResendCooldown.
+func otpReplaceableBefore(now time.Time) time.Time {
+	return now.Add(-otpResendCooldown)
+}
+
+// GenerateOTP returns a random 6-digit code from a cryptographically secure
+// source.
+func GenerateOTP() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// issueOTP creates a new code for the email and purpose, replacing any
+// previous one. It returns errOTPCooldown if a code was issued less than
+// otpResendCooldown ago.
+func issueOTP(ctx context.Context, email, purpose string) (string, error) {
+	otp, err := GenerateOTP()
+	if err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(otp), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	// Only replace a code older than the cooldown. If a newer one exists the
+	// filter does not match, the upsert collides with the unique index, and
+	// the request is throttled; this holds across replicas.
+	filter := bson.M{
+		"email":      email,
+		"purpose":    purpose,
+		"created_at": bson.M{"$lte": otpReplaceableBefore(now)},
+	}
+	update := bson.M{"$set": bson.M{
+		"code_hash":  string(hash),
+		"attempts":   0,
+		"created_at": now,
+		"expires_at": now.Add(otpTTL),
+	}}
+	_, err = otpCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return "", errOTPCooldown
+	}
+	if err != nil {
+		return "", err
+	}
+	return otp, nil
+}
+
+// discardOTP removes the pending code, e.g. when it could not be delivered.
+func discardOTP(ctx context.Context, email, purpose string) error {
+	_, err := otpCollection.DeleteOne(ctx, bson.M{"email": email, "purpose": purpose})
+	return err
+}
+
+// checkOTPAttempt checks a code against the record, whose Attempts already
+// counts this attempt. Only the first otpMaxAttempts attempts are compared;
+// the one using up the last attempt reports errOTPTooManyAttempts when wrong.
+func checkOTPAttempt(record *OTPRecord, otp string) error {
+	if record.Attempts > otpMaxAttempts {
+		return errOTPTooManyAttempts
+	}
+	if bcrypt.CompareHashAndPassword([]byte(record.CodeHash), []byte(otp)) != nil {
+		if record.Attempts == otpMaxAttempts {
+			return errOTPTooManyAttempts
+		}
+		return errOTPInvalid
+	}
+	return nil
+}
+
+// verifyOTP checks a code and consumes it on success. Every call counts as an
+// attempt, and the code stops working after otpMaxAttempts.
+func verifyOTP(ctx context.Context, email, purpose, otp string) error {
+	filter := bson.M{
+		"email":      email,
+		"purpose":    purpose,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	// Counting the attempt first gives concurrent attempts distinct numbers,
+	// so no more than otpMaxAttempts of them are ever compared
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var record OTPRecord
+	err := otpCollection.FindOneAndUpdate(ctx, filter, bson.M{"$inc": bson.M{"attempts": 1}}, opts).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return errOTPExpired
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkOTPAttempt(&record, otp); err != nil {
+		return err
+	}
+	// Delete by hash so a code can only be consumed once, even when two
+	// replicas verify it at the same time
+	res, err := otpCollection.DeleteOne(ctx, bson.M{"_id": record.ID, "code_hash": record.CodeHash})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return errOTPExpired
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// saveOTPSettings restores the OTP settings when the test ends and unsets
+// the OTP_* variables for it.
+func saveOTPSettings(t *testing.T) {
+	t.Helper()
+	ttl, maxAttempts, cooldown := otpTTL, otpMaxAttempts, otpResendCooldown
+	t.Cleanup(func() {
+		otpTTL, otpMaxAttempts, otpResendCooldown = ttl, maxAttempts, cooldown
+	})
+	for _, name := range []string{"OTP_TTL", "OTP_MAX_ATTEMPTS", "OTP_RESEND_COOLDOWN"} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestLoadOTPSettings(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantAttempts int
+		wantCooldown time.Duration
+		wantErr      bool
+	}{
+		{"defaults", nil, 5, time.Minute, false},
+		{"overrides", map[string]string{"OTP_MAX_ATTEMPTS": "3", "OTP_RESEND_COOLDOWN": "30s"}, 3, 30 * time.Second, false},
+		{"no cooldown", map[string]string{"OTP_RESEND_COOLDOWN": "0s"}, 5, 0, false},
+		{"zero attempts", map[string]string{"OTP_MAX_ATTEMPTS": "0"}, 0, 0, true},
+		{"attempts not a number", map[string]string{"OTP_MAX_ATTEMPTS": "five"}, 0, 0, true},
+		{"negative cooldown", map[string]string{"OTP_RESEND_COOLDOWN": "-1s"}, 0, 0, true},
+		{"zero TTL", map[string]string{"OTP_TTL": "0s"}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saveOTPSettings(t)
+			otpTTL, otpMaxAttempts, otpResendCooldown = 10*time.Minute, 5, time.Minute
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			err := loadOTPSettings()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("loadOTPSettings() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if otpMaxAttempts != tt.wantAttempts || otpResendCooldown != tt.wantCooldown {
+				t.Errorf("attempts, cooldown = %d, %v, want %d, %v", otpMaxAttempts, otpResendCooldown, tt.wantAttempts, tt.wantCooldown)
+			}
+		})
+	}
+}
+
+func TestCheckOTPAttempt(t *testing.T) {
+	saveOTPSettings(t)
+	otpMaxAttempts = 3
+	hash, err := bcrypt.GenerateFromPassword([]byte("123456"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		codes []string // tried in order
+		want  []error
+	}{
+		{"right first time", []string{"123456"}, []error{nil}},
+		{"right after a wrong one", []string{"000000", "123456"}, []error{errOTPInvalid, nil}},
+		{"right on the last attempt", []string{"000000", "111111", "123456"}, []error{errOTPInvalid, errOTPInvalid, nil}},
+		{"last attempt wrong", []string{"000000", "111111", "222222"}, []error{errOTPInvalid, errOTPInvalid, errOTPTooManyAttempts}},
+		{"locked code", []string{"000000", "111111", "222222", "123456"}, []error{errOTPInvalid, errOTPInvalid, errOTPTooManyAttempts, errOTPTooManyAttempts}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := &OTPRecord{CodeHash: string(hash)}
+			for i, code := range tt.codes {
+				// verifyOTP counts the attempt before checking it
+				record.Attempts++
+				if err := checkOTPAttempt(record, code); err != tt.want[i] {
+					t.Errorf("attempt %d with %s: %v, want %v", i+1, code, err, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOTPReplaceableBefore(t *testing.T) {
+	saveOTPSettings(t)
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		cooldown time.Duration
+		issued   time.Duration // before now
+		want     bool
+	}{
+		{time.Minute, 0, false},
+		{time.Minute, 59 * time.Second, false},
+		{time.Minute, time.Minute, true},
+		{time.Minute, 2 * time.Minute, true},
+		{0, 0, true},
+	}
+	for _, tt := range tests {
+		otpResendCooldown = tt.cooldown
+		// issueOTP only replaces codes with created_at <= the cutoff
+		got := !now.Add(-tt.issued).After(otpReplaceableBefore(now))
+		if got != tt.want {
+			t.Errorf("cooldown %v, issued %v ago: replaceable = %v, want %v", tt.cooldown, tt.issued, got, tt.want)
+		}
+	}
+}
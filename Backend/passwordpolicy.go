@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The bundled list of common and breached passwords, extended at startup
+// with PASSWORD_BLOCKLIST_FILE.
+//
+//go:embed passwords/common.txt
+var passwordListFS embed.FS
+
+// PasswordPolicy is what a password chosen by a user must satisfy. It is
+// read from the environment by initPasswordPolicy:
+//
+//	PASSWORD_MIN_LENGTH      minimum length in characters (defaults to 8)
+//	PASSWORD_MIN_CLASSES     how many of lowercase, uppercase, digits and
+//	                         symbols must appear, 1 to 4 (defaults to 2)
+//	PASSWORD_BLOCKLIST_FILE  extra passwords to refuse, one per line
+type PasswordPolicy struct {
+	MinLength        int  `json:"minLength"`
+	MaxLength        int  `json:"maxLength"`
+	MinClasses       int  `json:"minClasses"`
+	DisallowIdentity bool `json:"disallowUsernameOrEmail"`
+	RejectCommon     bool `json:"rejectCommon"`
+}
+
+// bcrypt ignores everything after 72 bytes.
+const passwordMaxBytes = 72
+
+var passwordPolicy = PasswordPolicy{
+	MinLength:        8,
+	MaxLength:        passwordMaxBytes,
+	MinClasses:       2,
+	DisallowIdentity: true,
+	RejectCommon:     true,
+}
+
+var commonPasswords = map[string]bool{}
+
+// initPasswordPolicy reads the policy settings and loads the password
+// blocklists.
+func initPasswordPolicy() error {
+	if raw := os.Getenv("PASSWORD_MIN_LENGTH"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > passwordMaxBytes {
+			return fmt.Errorf("invalid PASSWORD_MIN_LENGTH %q", raw)
+		}
+		passwordPolicy.MinLength = n
+	}
+	if raw := os.Getenv("PASSWORD_MIN_CLASSES"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 4 {
+			return fmt.Errorf("invalid PASSWORD_MIN_CLASSES %q", raw)
+		}
+		passwordPolicy.MinClasses = n
+	}
+
+	bundled, err := passwordListFS.Open("passwords/common.txt")
+	if err != nil {
+		return err
+	}
+	defer bundled.Close()
+	if err := loadPasswordList(bundled); err != nil {
+		return err
+	}
+	if path := os.Getenv("PASSWORD_BLOCKLIST_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("invalid PASSWORD_BLOCKLIST_FILE: %v", err)
+		}
+		defer f.Close()
+		if err := loadPasswordList(f); err != nil {
+			return fmt.Errorf("invalid PASSWORD_BLOCKLIST_FILE: %v", err)
+		}
+	}
+	return nil
+}
+
+func loadPasswordList(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commonPasswords[strings.ToLower(line)] = true
+	}
+	return scanner.Err()
+}
+
+// isCommonPassword reports whether the password is on a blocklist, also
+// when it only adds digits or symbols to the end of a listed one, as in
+// "Sunshine2024!".
+func isCommonPassword(password string) bool {
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return true
+	}
+	base := strings.TrimRightFunc(lower, func(r rune) bool { return !unicode.IsLetter(r) })
+	return len(base) >= 4 && base != lower && commonPasswords[base]
+}
+
+// checkPassword returns every way the password breaks the policy, or nil if
+// it is acceptable. username and email may be empty when unknown.
+func checkPassword(password, username, email string) []string {
+	var problems []string
+	if len([]rune(password)) < passwordPolicy.MinLength {
+		problems = append(problems, fmt.Sprintf("Password must be at least %d characters", passwordPolicy.MinLength))
+	}
+	if len(password) > passwordPolicy.MaxLength {
+		problems = append(problems, fmt.Sprintf("Password must be at most %d bytes", passwordPolicy.MaxLength))
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			classes++
+		}
+	}
+	if classes < passwordPolicy.MinClasses {
+		problems = append(problems, fmt.Sprintf("Password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", passwordPolicy.MinClasses))
+	}
+
+	if passwordPolicy.DisallowIdentity {
+		lowered := strings.ToLower(password)
+		local, _, _ := strings.Cut(strings.ToLower(email), "@")
+		for _, identity := range []string{strings.ToLower(strings.TrimSpace(username)), local} {
+			if len(identity) >= 3 && strings.Contains(lowered, identity) {
+				problems = append(problems, "Password must not contain your username or email address")
+				break
+			}
+		}
+	}
+	if passwordPolicy.RejectCommon && isCommonPassword(password) {
+		problems = append(problems, "Password is too common or has appeared in a data breach, choose another")
+	}
+	return problems
+}
+
+// validatePassword checks a password a user is setting and writes a 400
+// response listing the problems when it is not acceptable.
+func validatePassword(c *gin.Context, password, username, email string) bool {
+	problems := checkPassword(password, username, email)
+	if len(problems) == 0 {
+		return true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":          strings.Join(problems, ". "),
+		"passwordErrors": problems,
+	})
+	return false
+}
+
+// GetPasswordPolicy describes the password rules so forms can show them.
+func GetPasswordPolicy(c *gin.Context) {
+	c.JSON(http.StatusOK, passwordPolicy)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// loadDefaultPasswordPolicy sets up the default policy with the bundled
+// blocklist, ignoring any PASSWORD_* variables of the environment.
+func loadDefaultPasswordPolicy(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"PASSWORD_MIN_LENGTH", "PASSWORD_MIN_CLASSES", "PASSWORD_BLOCKLIST_FILE"} {
+		t.Setenv(name, "")
+	}
+	saved := passwordPolicy
+	t.Cleanup(func() { passwordPolicy = saved })
+	if err := initPasswordPolicy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsCommonPassword(t *testing.T) {
+	loadDefaultPasswordPolicy(t)
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password", true},
+		{"PassWord", true},
+		{"qwerty123", true},
+		{"Sunshine2024!", true},
+		{"letmein!!", true},
+		{"pass1", true},
+		{"Passwords1", false},
+		{"abc1", false}, // too short a base to count as listed
+		{"Tr0ub4dor&3", false},
+		{"correct horse battery staple", false},
+	}
+	for _, tt := range tests {
+		if got := isCommonPassword(tt.password); got != tt.want {
+			t.Errorf("isCommonPassword(%q) = %v, want %v", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	loadDefaultPasswordPolicy(t)
+	tests := []struct {
+		name     string
+		password string
+		username string
+		email    string
+		// A fragment of each expected problem, in order
+		want []string
+	}{
+		{"acceptable", "Tr0ub4dor&3", "alice", "alice@example.com", nil},
+		{"too short", "Xy7#ab", "alice", "alice@example.com", []string{"at least 8 characters"}},
+		{"too long", "Aa1" + strings.Repeat("x", 70), "", "", []string{"at most 72 bytes"}},
+		{"one class", "zqxjvkwpmt", "", "", []string{"at least 2 of"}},
+		{"contains username", "MyAlice#2024", "Alice", "a@example.com", []string{"username or email"}},
+		{"contains email", "x-john.doe-9", "", "john.doe@example.com", []string{"username or email"}},
+		{"short username allowed", "Al-7zqxjvk", "al", "", nil},
+		{"common", "Sunshine2024!", "", "", []string{"too common"}},
+		{"several", "sunshine", "", "", []string{"at least 2 of", "too common"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := checkPassword(tt.password, tt.username, tt.email)
+			if len(problems) != len(tt.want) {
+				t.Fatalf("checkPassword(%q) = %q, want %d problems", tt.password, problems, len(tt.want))
+			}
+			for i, fragment := range tt.want {
+				if !strings.Contains(problems[i], fragment) {
+					t.Errorf("problem %d = %q, want it to mention %q", i, problems[i], fragment)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckPasswordMinClasses(t *testing.T) {
+	loadDefaultPasswordPolicy(t)
+	passwordPolicy.MinClasses = 4
+	if problems := checkPassword("Zqxjvk7pmt", "", ""); len(problems) != 1 {
+		t.Errorf("three classes with MinClasses 4: got %q, want one problem", problems)
+	}
+	if problems := checkPassword("Zqxjvk7p#t", "", ""); problems != nil {
+		t.Errorf("four classes with MinClasses 4: got %q, want none", problems)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PasswordReset is a single-use token issued after the user proved control
+// of their email with a reset_password OTP. ForgotPassword only accepts a
+// password change that presents one.
+type PasswordReset struct {
+	TokenHash string    `bson:"token_hash"`
+	Email     string    `bson:"email"`
+	CreatedAt time.Time `bson:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+var passwordResetCollection *mongo.Collection
+
+// passwordResetTTL is how long a reset token is valid, overridable through
+// PASSWORD_RESET_TTL.
+var passwordResetTTL = 15 * time.Minute
+
+var errResetTokenInvalid = errors.New("invalid or expired reset token")
+
+// initPasswordResets reads the reset token lifetime and creates the
+// password_resets indexes.
+func initPasswordResets(ctx context.Context) error {
+	if raw := os.Getenv("PASSWORD_RESET_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid PASSWORD_RESET_TTL %q", raw)
+		}
+		passwordResetTTL = ttl
+	}
+	_, err := passwordResetCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// issueResetToken creates a reset token for the email. Any older token for
+// the same email is discarded so only the latest one works.
+func issueResetToken(ctx context.Context, email string) (string, error) {
+	return issuePasswordToken(ctx, email, passwordResetTTL)
+}
+
+// issuePasswordToken is issueResetToken with a custom lifetime, for links
+// that sit in an inbox longer than a reset the user just asked for.
+func issuePasswordToken(ctx context.Context, email string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	if _, err := passwordResetCollection.DeleteMany(ctx, bson.M{"email": email}); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err := passwordResetCollection.InsertOne(ctx, PasswordReset{
+		TokenHash: hashToken(token),
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// resetTokenEmail returns the email a valid reset token belongs to without
+// spending it, so the new password can be checked first.
+func resetTokenEmail(ctx context.Context, token string) (string, error) {
+	filter := bson.M{
+		"token_hash": hashToken(token),
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	var reset PasswordReset
+	err := passwordResetCollection.FindOne(ctx, filter).Decode(&reset)
+	if err == mongo.ErrNoDocuments {
+		return "", errResetTokenInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	return reset.Email, nil
+}
+
+// consumeResetToken deletes the reset token and returns the email it was
+// issued for. A token can only be consumed once.
+func consumeResetToken(ctx context.Context, token string) (string, error) {
+	filter := bson.M{
+		"token_hash": hashToken(token),
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	var reset PasswordReset
+	err := passwordResetCollection.FindOneAndDelete(ctx, filter).Decode(&reset)
+	if err == mongo.ErrNoDocuments {
+		return "", errResetTokenInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	return reset.Email, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Global roles stored in User.Role. Instructors and TAs only get rights in
+// the courses they are assigned to through course_staff; admins have every
+// right everywhere.
+const (
+	roleStudent    = "student"
+	roleInstructor = "instructor"
+	roleTA         = "ta"
+	roleAdmin      = "admin"
+)
+
+// Course permissions.
+const (
+	permContentWrite    = "content:write"    // resources, notes, assignments and quizzes
+	permContentDelete   = "content:delete"   // deleting assignments
+	permSubmissionsRead = "submissions:read" // viewing assignment submissions
+	permGradesWrite     = "grades:write"     // grading submissions
+)
+
+// coursePermissionsByRole lists what each course staff role may do.
+var coursePermissionsByRole = map[string][]string{
+	roleInstructor: {permContentWrite, permContentDelete, permSubmissionsRead, permGradesWrite},
+	roleTA:         {permSubmissionsRead, permGradesWrite},
+}
+
+// adminCoursePermissions is what an admin may do in any course.
+var adminCoursePermissions = coursePermissionsByRole[roleInstructor]
+
+func validRole(role string) bool {
+	switch role {
+	case roleStudent, roleInstructor, roleTA, roleAdmin:
+		return true
+	}
+	return false
+}
+
+// CourseStaff assigns an instructor or TA to a course.
+type CourseStaff struct {
+	Course     string    `json:"course" bson:"course"`
+	Email      string    `json:"email" bson:"email"`
+	Role       string    `json:"role" bson:"role"`
+	AssignedAt time.Time `json:"assigned_at" bson:"assigned_at"`
+}
+
+// CoursePermissions is what a user may do in one course.
+type CoursePermissions struct {
+	Course      string   `json:"course"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+var courseStaffCollection *mongo.Collection
+
+// initCourseStaff creates the course_staff indexes.
+func initCourseStaff(ctx context.Context) error {
+	_, err := courseStaffCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "course", Value: 1}, {Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+	})
+	return err
+}
+
+// coursePermissionsFor returns what a user with the global role may do in a
+// course where their staff role is staffRole, empty if they are not
+// assigned to it.
+func coursePermissionsFor(role, staffRole string) []string {
+	switch role {
+	case roleAdmin:
+		return adminCoursePermissions
+	case roleInstructor, roleTA:
+		return coursePermissionsByRole[staffRole]
+	}
+	return nil
+}
+
+// coursePermissions returns the user's permissions in a course, or nil if
+// they have none.
+func coursePermissions(ctx context.Context, user User, course string) ([]string, error) {
+	if user.Role != roleInstructor && user.Role != roleTA {
+		return coursePermissionsFor(user.Role, ""), nil
+	}
+	var staff CourseStaff
+	err := courseStaffCollection.FindOne(ctx, bson.M{"course": course, "email": user.Email}).Decode(&staff)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	return coursePermissionsFor(user.Role, staff.Role), nil
+}
+
+// hasCoursePermission reports whether the user may do perm in course.
+func hasCoursePermission(ctx context.Context, user User, course, perm string) (bool, error) {
+	perms, err := coursePermissions(ctx, user, course)
+	if err != nil {
+		return false, err
+	}
+	return containsPermission(perms, perm), nil
+}
+
+func containsPermission(perms []string, perm string) bool {
+	for _, p := range perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// staffCourses lists the courses the user is assigned to with their
+// permissions in each. Admins get an empty list as they are not scoped.
+func staffCourses(ctx context.Context, email string) ([]CoursePermissions, error) {
+	cursor, err := courseStaffCollection.Find(ctx, bson.M{"email": email}, options.Find().SetSort(bson.D{{Key: "course", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var assignments []CourseStaff
+	if err := cursor.All(ctx, &assignments); err != nil {
+		return nil, err
+	}
+	courses := []CoursePermissions{}
+	for _, a := range assignments {
+		courses = append(courses, CoursePermissions{Course: a.Course, Role: a.Role, Permissions: coursePermissionsByRole[a.Role]})
+	}
+	return courses, nil
+}
+
+// RequireCoursePermission rejects the request unless the authenticated user
+// holds perm in the course named by the :course parameter. Like RequireRole
+// it must be registered after AuthMiddleware.
+func RequireCoursePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		user, err := findUserByEmail(ctx, c.GetString("email"))
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: User not found"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user role"})
+			}
+			c.Abort()
+			return
+		}
+		allowed, err := hasCoursePermission(ctx, user, c.Param("course"), perm)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load course permissions"})
+			c.Abort()
+			return
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Insufficient permissions"})
+			c.Abort()
+			return
+		}
+		c.Set("role", user.Role)
+		c.Next()
+	}
+}
+
+// SetUserRole promotes or demotes a user. Course staff assignments the new
+// role does not allow are dropped.
+func SetUserRole(c *gin.Context) {
+	var input struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || !validRole(input.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be student, instructor, ta or admin"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	if isSelf(c, user) && input.Role != roleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot demote yourself"})
+		return
+	}
+	_, err := userCollection.UpdateOne(ctx, bson.M{"email": user.Email}, bson.M{"$set": bson.M{"role": input.Role}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+
+	staffFilter := bson.M{"email": user.Email}
+	switch input.Role {
+	case roleInstructor:
+		staffFilter = nil
+	case roleTA:
+		staffFilter["role"] = roleInstructor
+	}
+	if staffFilter != nil {
+		if _, err := courseStaffCollection.DeleteMany(ctx, staffFilter); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update course staff"})
+			return
+		}
+	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditSetRole,
+		TargetType: auditTargetUser,
+		Target:     user.Email,
+		Before:     bson.M{"role": user.Role},
+		After:      bson.M{"role": input.Role},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated", "role": input.Role})
+}
+
+// GetCourseStaff lists the instructors and TAs of a course.
+func GetCourseStaff(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := courseStaffCollection.Find(ctx, bson.M{"course": c.Param("course")})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course staff"})
+		return
+	}
+	staff := []CourseStaff{}
+	if err := cursor.All(ctx, &staff); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse course staff"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"staff": staff})
+}
+
+// AssignCourseStaff makes an instructor or TA staff of a course, or changes
+// their role in it. The user's global role must allow the course role: only
+// instructors can be assigned as instructors.
+func AssignCourseStaff(c *gin.Context) {
+	var input struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || (input.Role != roleInstructor && input.Role != roleTA) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email and a role of instructor or ta are required"})
+		return
+	}
+	courseName := c.Param("course")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := coursesCollection.FindOne(ctx, bson.M{"name": courseName}).Err(); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+		return
+	}
+	user, err := findUserByEmail(ctx, input.Email)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.Role != roleInstructor && !(input.Role == roleTA && user.Role == roleTA) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User's role does not allow this course role"})
+		return
+	}
+
+	_, err = courseStaffCollection.UpdateOne(ctx,
+		bson.M{"course": courseName, "email": user.Email},
+		bson.M{"$set": bson.M{"role": input.Role, "assigned_at": time.Now()}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign course staff"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Course staff assigned"})
+}
+
+// RemoveCourseStaff removes a user from a course's staff.
+func RemoveCourseStaff(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := courseStaffCollection.DeleteOne(ctx, bson.M{"course": c.Param("course"), "email": c.Param("email")},
+		options.Delete().SetCollation(caseInsensitive))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove course staff"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not staff of this course"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Course staff removed"})
+}
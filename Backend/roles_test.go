@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestCoursePermissionsFor(t *testing.T) {
+	all := []string{permContentWrite, permContentDelete, permSubmissionsRead, permGradesWrite}
+	tests := []struct {
+		name      string
+		role      string
+		staffRole string // "" when not assigned to the course
+		allowed   []string
+	}{
+		{"admin", roleAdmin, "", all},
+		{"instructor of the course", roleInstructor, roleInstructor, all},
+		{"instructor as TA of the course", roleInstructor, roleTA, []string{permSubmissionsRead, permGradesWrite}},
+		{"instructor of another course", roleInstructor, "", nil},
+		{"TA of the course", roleTA, roleTA, []string{permSubmissionsRead, permGradesWrite}},
+		{"TA of another course", roleTA, "", nil},
+		{"student", roleStudent, "", nil},
+		// Staff records left behind by a demotion grant nothing
+		{"demoted to student", roleStudent, roleInstructor, nil},
+		{"no role", "", roleInstructor, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perms := coursePermissionsFor(tt.role, tt.staffRole)
+			for _, perm := range all {
+				want := containsPermission(tt.allowed, perm)
+				if got := containsPermission(perms, perm); got != want {
+					t.Errorf("%s: allowed = %v, want %v", perm, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidRole(t *testing.T) {
+	for _, role := range []string{roleStudent, roleInstructor, roleTA, roleAdmin} {
+		if !validRole(role) {
+			t.Errorf("validRole(%q) = false", role)
+		}
+	}
+	for _, role := range []string{"", "Admin", "teacher", "superuser"} {
+		if validRole(role) {
+			t.Errorf("validRole(%q) = true", role)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Invitation settings, overridable through INVITATION_TTL and
+// INVITATION_URL. The link sent to invited users is INVITATION_URL with the
+// set-password token appended as ?token=.
+var (
+	invitationTTL = 7 * 24 * time.Hour
+	invitationURL = "http://localhost:5173/set-password"
+)
+
+const (
+	rosterMaxBytes = 5 << 20
+	rosterMaxRows  = 5000
+)
+
+// unusablePassword is stored for invited users until they choose a password
+// through their invitation. It is not a bcrypt hash, so no password matches
+// it, and it costs nothing to create for thousands of rows.
+const unusablePassword = "!invited"
+
+// rosterColumns maps accepted CSV headers to the field they fill.
+var rosterColumns = map[string]string{
+	"username":    "username",
+	"email":       "email",
+	"role":        "role",
+	"full_name":   "full_name",
+	"full name":   "full_name",
+	"fullname":    "full_name",
+	"name":        "full_name",
+	"grade":       "grade",
+	"school":      "school",
+	"school_name": "school",
+	"school name": "school",
+}
+
+// RosterRow is one line of the import report.
+type RosterRow struct {
+	Row      int    `json:"row"`
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Status   string `json:"status"` // created, existing or error
+	Invited  bool   `json:"invited"`
+	Error    string `json:"error,omitempty"`
+}
+
+// initInvitations reads the invitation settings.
+func initInvitations() error {
+	if raw := os.Getenv("INVITATION_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid INVITATION_TTL %q", raw)
+		}
+		invitationTTL = ttl
+	}
+	if raw := os.Getenv("INVITATION_URL"); raw != "" {
+		if u, err := url.Parse(raw); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid INVITATION_URL %q", raw)
+		}
+		invitationURL = raw
+	}
+	return nil
+}
+
+// sendInvitation emails a link to choose a password. Using the link proves
+// the address, so it also verifies the account.
+func sendInvitation(ctx context.Context, user User) error {
+	token, err := issuePasswordToken(ctx, user.Email, invitationTTL)
+	if err != nil {
+		return err
+	}
+	separator := "?"
+	if strings.Contains(invitationURL, "?") {
+		separator = "&"
+	}
+	return enqueueEmail(ctx, emailInvitation, gin.H{
+		"Username":      user.Username,
+		"Link":          invitationURL + separator + url.Values{"token": {token}}.Encode(),
+		"ExpiresInDays": int(invitationTTL.Hours() / 24),
+	}, user.Email)
+}
+
+// importRosterRow creates the account for one row, or recognizes that an
+// earlier upload already did. It returns whether a user was created.
+func importRosterRow(ctx context.Context, username, email, role, fullName, grade, school string) (bool, error) {
+	created := false
+	existing, err := findUserByEmail(ctx, email)
+	switch {
+	case err == nil:
+		if !strings.EqualFold(existing.Username, username) {
+			return false, fmt.Errorf("email is already registered to %s", existing.Username)
+		}
+		username = existing.Username
+	case err == mongo.ErrNoDocuments:
+		_, err = userCollection.InsertOne(ctx, User{
+			Username: username,
+			Email:    email,
+			Password: unusablePassword,
+			Role:     role,
+			Status:   userStatusPendingVerification,
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			return false, errors.New("username is already taken")
+		}
+		if err != nil {
+			return false, err
+		}
+		created = true
+	default:
+		return false, err
+	}
+
+	// Upserts, so a re-upload fills in what an interrupted one missed
+	details := bson.M{}
+	for field, value := range map[string]string{"full_name": fullName, "grade": grade, "school_name": school} {
+		if value != "" {
+			details[field] = value
+		}
+	}
+	update := bson.M{"$setOnInsert": bson.M{"email": email}}
+	if len(details) > 0 {
+		update["$set"] = details
+	}
+	if _, err := detailsCollection.UpdateOne(ctx, bson.M{"email": email}, update, options.Update().SetUpsert(true)); err != nil {
+		return created, err
+	}
+	_, err = leaderboardCollection.UpdateOne(ctx,
+		bson.M{"username": username},
+		bson.M{"$setOnInsert": bson.M{"username": username, "points": 0}},
+		options.Update().SetUpsert(true))
+	return created, err
+}
+
+// rosterEntry is a row of the upload that passed validation.
+type rosterEntry struct {
+	row                           RosterRow
+	role, fullName, grade, school string
+}
+
+var (
+	errRosterMissingColumns = errors.New("roster header lacks username or email")
+	errRosterTooManyRows    = errors.New("roster has too many rows")
+)
+
+// parseRoster reads and validates every row of an upload. Rows that fail
+// validation come back with status "error"; the returned error is for
+// problems with the file as a whole. Nothing is written, so an oversized
+// upload is refused before any account is created.
+func parseRoster(r io.Reader) ([]rosterEntry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if field, ok := rosterColumns[name]; ok {
+			columns[field] = i
+		}
+	}
+	if _, ok := columns["username"]; !ok {
+		return nil, errRosterMissingColumns
+	}
+	if _, ok := columns["email"]; !ok {
+		return nil, errRosterMissingColumns
+	}
+
+	var entries []rosterEntry
+	rows := 0
+	seen := map[string]int{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		// Rows are reported by their line in the file, which the reader
+		// knows even when it skips empty lines
+		var line int
+		var parseErr *csv.ParseError
+		switch {
+		case errors.As(err, &parseErr):
+			line = parseErr.StartLine
+		case err != nil:
+			return nil, err
+		case strings.Join(record, "") == "":
+			continue
+		default:
+			line, _ = reader.FieldPos(0)
+		}
+		if rows++; rows > rosterMaxRows {
+			return nil, errRosterTooManyRows
+		}
+		row := RosterRow{Row: line}
+		fail := func(message string) {
+			row.Status = "error"
+			row.Error = message
+			entries = append(entries, rosterEntry{row: row})
+		}
+		if err != nil {
+			fail("Malformed CSV line")
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		row.Username = field("username")
+		row.Email = field("email")
+		role := strings.ToLower(field("role"))
+		if role == "" {
+			role = roleStudent
+		}
+		email, ok := normalizeEmail(row.Email)
+		switch {
+		case row.Username == "":
+			fail("Username is required")
+			continue
+		case !ok:
+			fail("Invalid email address")
+			continue
+		case !validRole(role):
+			fail("Role must be student, instructor, ta or admin")
+			continue
+		}
+		row.Email = email
+		if first, dup := seen[email]; dup {
+			fail(fmt.Sprintf("Duplicate of row %d", first))
+			continue
+		}
+		seen[email] = line
+		entries = append(entries, rosterEntry{row: row, role: role, fullName: field("full_name"), grade: field("grade"), school: field("school")})
+	}
+	return entries, nil
+}
+
+// ImportRoster creates accounts from a CSV upload (form field "file") with
+// the columns username, email, role, full_name, grade and school; only
+// username and email are required, role defaults to student. New users get
+// an invitation email. Rows whose account already exists are reported as
+// existing, so the same file can be uploaded again safely; pass
+// ?resend=true to re-invite those that have not accepted yet.
+func ImportRoster(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, rosterMaxBytes)
+	file, fileHeader, err := c.Request.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A CSV file is required"})
+		return
+	}
+	defer file.Close()
+	resend := c.Query("resend") == "true"
+
+	entries, err := parseRoster(file)
+	switch err {
+	case nil:
+	case errRosterTooManyRows:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d rows can be imported at once", rosterMaxRows)})
+		return
+	case errRosterMissingColumns:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV header must include username and email"})
+		return
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read the CSV file"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	report := []RosterRow{}
+	counts := map[string]int{"created": 0, "existing": 0, "error": 0, "invited": 0}
+	createdUsers := []string{}
+	for _, entry := range entries {
+		row, email := entry.row, entry.row.Email
+		fail := func(message string) {
+			row.Status = "error"
+			row.Error = message
+			counts["error"]++
+			report = append(report, row)
+		}
+		if row.Status == "error" {
+			counts["error"]++
+			report = append(report, row)
+			continue
+		}
+
+		created, err := importRosterRow(ctx, row.Username, email, entry.role, entry.fullName, entry.grade, entry.school)
+		if err != nil {
+			if created {
+				requestLog(c).Warn("Roster import created user with incomplete details", "email", email, "error", err)
+			}
+			fail(err.Error())
+			continue
+		}
+		row.Status = "existing"
+		if created {
+			row.Status = "created"
+		}
+		counts[row.Status]++
+		if created {
+			createdUsers = append(createdUsers, email)
+		}
+
+		if created || resend {
+			user, err := findUserByEmail(ctx, email)
+			if err == nil && user.Status == userStatusPendingVerification {
+				if err := sendInvitation(ctx, user); err != nil {
+					requestLog(c).Error("Invitation not queued", "email", email, "error", err)
+					row.Error = "Account ready but the invitation could not be sent"
+				} else {
+					row.Invited = true
+					counts["invited"]++
+				}
+			}
+		}
+		report = append(report, row)
+	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditImportRoster,
+		TargetType: auditTargetRoster,
+		Target:     fileHeader.Filename,
+		After: bson.M{
+			"created":  counts["created"],
+			"existing": counts["existing"],
+			"error":    counts["error"],
+			"invited":  counts["invited"],
+			"users":    createdUsers,
+		},
+	})
+	c.JSON(http.StatusOK, gin.H{"summary": counts, "rows": report})
+}
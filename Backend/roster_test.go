@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseRoster(t *testing.T) {
+	type want struct {
+		row      int
+		username string
+		email    string
+		role     string
+		err      string // the row's error, "" when it is valid
+	}
+	tests := []struct {
+		name string
+		csv  string
+		want []want
+	}{
+		{
+			"all columns",
+			"username,email,role,full_name,grade,school\nada,Ada@Example.com,Instructor,Ada Lovelace,12,Analytical\n",
+			[]want{{2, "ada", "ada@example.com", roleInstructor, ""}},
+		},
+		{
+			"role defaults to student",
+			"email,username\nbob@example.com,bob\n",
+			[]want{{2, "bob", "bob@example.com", roleStudent, ""}},
+		},
+		{
+			"header aliases, spaces and a byte order mark",
+			"\ufeffUsername, E-mail ,Email,Full Name\n  carol , x ,carol@example.com,Carol\n",
+			[]want{{2, "carol", "carol@example.com", roleStudent, ""}},
+		},
+		{
+			"blank lines keep the row numbers",
+			"username,email\n\ndan@example.com\n,\neve,eve@example.com\n",
+			[]want{{3, "dan@example.com", "", "", "Invalid email address"}, {5, "eve", "eve@example.com", roleStudent, ""}},
+		},
+		{
+			"missing username",
+			"username,email\n,frank@example.com\n",
+			[]want{{2, "", "frank@example.com", "", "Username is required"}},
+		},
+		{
+			"invalid email",
+			"username,email\ngina,gina@\nhal,Hal <hal@example.com>\n",
+			[]want{{2, "gina", "gina@", "", "Invalid email address"}, {3, "hal", "Hal <hal@example.com>", "", "Invalid email address"}},
+		},
+		{
+			"unknown role",
+			"username,email,role\nivy,ivy@example.com,superuser\n",
+			[]want{{2, "ivy", "ivy@example.com", "", "Role must be student, instructor, ta or admin"}},
+		},
+		{
+			"duplicate email",
+			"username,email\njack,jack@example.com\njack2,JACK@example.com\n",
+			[]want{{2, "jack", "jack@example.com", roleStudent, ""}, {3, "jack2", "jack@example.com", "", "Duplicate of row 2"}},
+		},
+		{
+			"malformed line",
+			"username,email\nk\"im,kim@example.com\nlee,lee@example.com\n",
+			[]want{{2, "", "", "", "Malformed CSV line"}, {3, "lee", "lee@example.com", roleStudent, ""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := parseRoster(strings.NewReader(tt.csv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tt.want) {
+				t.Fatalf("got %d entries, want %d: %+v", len(entries), len(tt.want), entries)
+			}
+			for i, w := range tt.want {
+				entry := entries[i]
+				if entry.row.Row != w.row || entry.row.Username != w.username || entry.row.Email != w.email {
+					t.Errorf("entry %d = row %d, %q, %q, want row %d, %q, %q", i, entry.row.Row, entry.row.Username, entry.row.Email, w.row, w.username, w.email)
+				}
+				if w.err != "" {
+					if entry.row.Status != "error" || entry.row.Error != w.err {
+						t.Errorf("entry %d = %q %q, want error %q", i, entry.row.Status, entry.row.Error, w.err)
+					}
+					continue
+				}
+				if entry.row.Status != "" || entry.role != w.role {
+					t.Errorf("entry %d = status %q, role %q, want valid with role %q", i, entry.row.Status, entry.role, w.role)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRosterDetails(t *testing.T) {
+	entries, err := parseRoster(strings.NewReader("username,email,name,grade,school name\nada,ada@example.com, Ada Lovelace ,12,Analytical\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	if e := entries[0]; e.fullName != "Ada Lovelace" || e.grade != "12" || e.school != "Analytical" {
+		t.Errorf("details = %q, %q, %q", e.fullName, e.grade, e.school)
+	}
+}
+
+func TestParseRosterFile(t *testing.T) {
+	var full strings.Builder
+	full.WriteString("username,email\n")
+	for i := 0; i < rosterMaxRows; i++ {
+		fmt.Fprintf(&full, "user%d,user%d@example.com\n", i, i)
+	}
+	// Blank lines do not count towards the limit
+	full.WriteString("\n\n")
+
+	tests := []struct {
+		name    string
+		csv     string
+		wantErr error // nil when the file is accepted
+	}{
+		{"at the row limit", full.String(), nil},
+		{"over the row limit", full.String() + "late,late@example.com\n", errRosterTooManyRows},
+		{"no username column", "name,email\nAda,ada@example.com\n", errRosterMissingColumns},
+		{"no email column", "username,mail\nada,ada@example.com\n", errRosterMissingColumns},
+		{"header only", "username,email\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseRoster(strings.NewReader(tt.csv)); err != tt.wantErr {
+				t.Errorf("parseRoster() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if _, err := parseRoster(strings.NewReader("")); err == nil {
+		t.Error("empty file accepted")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// mongoConnectAttempts and mongoRetryMaxDelay bound how long startup
+	// waits for MongoDB, e.g. while both come up together on deploy.
+	mongoConnectAttempts = 8
+	mongoRetryMaxDelay   = 15 * time.Second
+	mongoPingTimeout     = 5 * time.Second
+
+	// shutdownTimeout is how long in-flight requests, such as uploads and
+	// quiz submissions, get to finish after SIGTERM before they are cut off.
+	// It stays under the usual 30 second grace period of orchestrators.
+	shutdownTimeout = 25 * time.Second
+)
+
+// connectMongo connects to MongoDB, retrying with a growing delay until the
+// server answers a ping.
+func connectMongo(ctx context.Context, uri string) (*mongo.Client, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetMonitor(mongoMetricsMonitor()))
+	if err != nil {
+		return nil, err
+	}
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, mongoPingTimeout)
+		err = client.Ping(pingCtx, nil)
+		cancel()
+		if err == nil {
+			return client, nil
+		}
+		if attempt == mongoConnectAttempts {
+			break
+		}
+		slog.Warn("MongoDB not reachable, retrying", "attempt", attempt, "of", mongoConnectAttempts, "retry_in", delay.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			client.Disconnect(context.Background())
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, mongoRetryMaxDelay)
+	}
+	client.Disconnect(context.Background())
+	return nil, fmt.Errorf("giving up after %d attempts: %v", mongoConnectAttempts, err)
+}
+
+// serve runs the HTTP server and the email workers until ctx is cancelled,
+// then stops accepting connections, waits for in-flight requests and
+// background deliveries to finish and disconnects from MongoDB.
+func serve(ctx context.Context, handler http.Handler, client *mongo.Client) error {
+	server := &http.Server{
+		Addr:    config.ListenAddr,
+		Handler: handler,
+		// No overall read timeout: large uploads on slow links are expected
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	workers := startEmailWorkers(workerCtx)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("Server running", "addr", config.ListenAddr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-serverErr:
+		// Could not listen; nothing is in flight
+	case <-ctx.Done():
+		slog.Info("Shutting down, waiting for in-flight requests", "timeout", shutdownTimeout.String())
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err = server.Shutdown(shutdownCtx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.Warn("Shutdown timed out, closing remaining connections")
+			server.Close()
+		}
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+
+	stopWorkers()
+	workers.Wait()
+
+	disconnectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if derr := client.Disconnect(disconnectCtx); derr != nil {
+		slog.Error("MongoDB disconnect failed", "error", derr)
+	}
+	return err
+}
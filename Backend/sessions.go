@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Session is a server-side login. Access tokens carry the session ID and are
+// only accepted while the session is neither revoked nor expired; the
+// refresh token is rotated on every use and only its hash is stored.
+type Session struct {
+	ID                  primitive.ObjectID `json:"id" bson:"_id"`
+	Email               string             `json:"email" bson:"email"`
+	RefreshHash         string             `json:"-" bson:"refresh_hash"`
+	PreviousRefreshHash string             `json:"-" bson:"previous_refresh_hash,omitempty"`
+	UserAgent           string             `json:"user_agent" bson:"user_agent"`
+	IP                  string             `json:"ip" bson:"ip"`
+	CreatedAt           time.Time          `json:"created_at" bson:"created_at"`
+	LastSeenAt          time.Time          `json:"last_seen_at" bson:"last_seen_at"`
+	ExpiresAt           time.Time          `json:"expires_at" bson:"expires_at"`
+	RevokedAt           *time.Time         `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+	// ImpersonatedBy is set on sessions an admin opened to act as Email
+	ImpersonatedBy string `json:"impersonated_by,omitempty" bson:"impersonated_by,omitempty"`
+}
+
+var sessionCollection *mongo.Collection
+
+// refreshTokenTTL bounds how long a session can be kept alive by refreshing.
+var refreshTokenTTL = 30 * 24 * time.Hour
+
+// last_seen_at is only written when it is older than this, so browsing does
+// not cause a write per request.
+const sessionTouchInterval = time.Minute
+
+var (
+	errSessionInactive     = errors.New("session revoked or expired")
+	errRefreshTokenInvalid = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token already rotated")
+)
+
+// initSessions reads the refresh token lifetime from REFRESH_TOKEN_TTL and
+// creates the sessions indexes. Expired sessions are removed by MongoDB.
+func initSessions(ctx context.Context) error {
+	if raw := os.Getenv("REFRESH_TOKEN_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid REFRESH_TOKEN_TTL %q", raw)
+		}
+		refreshTokenTTL = ttl
+	}
+	_, err := sessionCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// hashToken returns the hex SHA-256 of a random token, which is what gets
+// stored instead of the token itself.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRefreshSecret returns a random secret and the refresh token handed to
+// the client, which is "<session id>.<secret>".
+func newRefreshSecret(id primitive.ObjectID) (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	return secret, id.Hex() + "." + secret, nil
+}
+
+// newSession describes a session for the user on the requesting device
+// without saving it.
+func newSession(c *gin.Context, email string) *Session {
+	now := time.Now()
+	return &Session{
+		ID:         primitive.NewObjectID(),
+		Email:      email,
+		UserAgent:  c.Request.UserAgent(),
+		IP:         c.ClientIP(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(refreshTokenTTL),
+	}
+}
+
+// createSession starts a new session for the user and returns it with its
+// refresh token.
+func createSession(ctx context.Context, c *gin.Context, email string) (*Session, string, error) {
+	session := newSession(c, email)
+	secret, refreshToken, err := newRefreshSecret(session.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	session.RefreshHash = hashToken(secret)
+	if _, err := sessionCollection.InsertOne(ctx, session); err != nil {
+		return nil, "", err
+	}
+	return session, refreshToken, nil
+}
+
+// activeSessionFilter matches the session with the given ID if it can still
+// be used.
+func activeSessionFilter(id primitive.ObjectID) bson.M {
+	return bson.M{
+		"_id":        id,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+}
+
+// loadActiveSession returns the session referenced by an access token, or
+// errSessionInactive if it has been revoked or has expired.
+func loadActiveSession(ctx context.Context, sessionID string) (*Session, error) {
+	id, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return nil, errSessionInactive
+	}
+	var session Session
+	err = sessionCollection.FindOne(ctx, activeSessionFilter(id)).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, errSessionInactive
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// sessionMatchesClaims reports whether an access token was issued for the
+// session. An impersonation session only accepts the token naming the same
+// admin, and a user's own session never accepts an impersonation token.
+func sessionMatchesClaims(session *Session, claims *Claims) bool {
+	return session.Email == claims.Email && session.ImpersonatedBy == claims.ImpersonatedBy
+}
+
+// touchSession records that the session was just used.
+func touchSession(ctx context.Context, session *Session) error {
+	now := time.Now()
+	if session.LastSeenAt.After(now.Add(-sessionTouchInterval)) {
+		return nil
+	}
+	_, err := sessionCollection.UpdateOne(ctx, bson.M{"_id": session.ID}, bson.M{"$set": bson.M{"last_seen_at": now}})
+	return err
+}
+
+// revokeSession ends a single session.
+func revokeSession(ctx context.Context, id primitive.ObjectID) error {
+	_, err := sessionCollection.UpdateOne(ctx, activeSessionFilter(id), bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	return err
+}
+
+// revokeUserSessions ends every active session of a user and returns how
+// many were revoked.
+func revokeUserSessions(ctx context.Context, email string) (int64, error) {
+	filter := bson.M{
+		"email":      email,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	res, err := sessionCollection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// parseRefreshToken splits a refresh token into its session ID and secret.
+func parseRefreshToken(token string) (primitive.ObjectID, string, bool) {
+	rawID, secret, ok := strings.Cut(token, ".")
+	id, err := primitive.ObjectIDFromHex(rawID)
+	if !ok || err != nil || secret == "" {
+		return primitive.NilObjectID, "", false
+	}
+	return id, secret, true
+}
+
+// checkRefreshSecret compares a presented refresh secret with the session's
+// current one. Matching the one it replaced instead gives
+// errRefreshTokenReused, as the token must have been copied before it was
+// rotated.
+func checkRefreshSecret(session *Session, secret string) error {
+	presented := hashToken(secret)
+	if session.PreviousRefreshHash != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(session.PreviousRefreshHash)) == 1 {
+		return errRefreshTokenReused
+	}
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(session.RefreshHash)) != 1 {
+		return errRefreshTokenInvalid
+	}
+	return nil
+}
+
+// sessionTokenResponse issues an access token for the session and builds the
+// JSON body shared by Login and RefreshToken.
+func sessionTokenResponse(session *Session, refreshToken string) (gin.H, error) {
+	tokenString, expiresAt, err := tokens.Issue(session.Email, session.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"token":            tokenString,
+		"expiresAt":        expiresAt,
+		"refreshToken":     refreshToken,
+		"refreshExpiresAt": session.ExpiresAt,
+	}, nil
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new
+// refresh token. Presenting an already rotated refresh token revokes the
+// session, since it means the token was copied.
+func RefreshToken(c *gin.Context) {
+	var input struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refresh token is required"})
+		return
+	}
+	id, secret, ok := parseRefreshToken(input.RefreshToken)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var session Session
+	err := sessionCollection.FindOne(ctx, activeSessionFilter(id)).Decode(&session)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session expired or revoked"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load session"})
+		}
+		return
+	}
+
+	switch checkRefreshSecret(&session, secret) {
+	case errRefreshTokenReused:
+		if err := revokeSession(ctx, session.ID); err != nil {
+			// The copied token must not be left usable unnoticed
+			requestLog(c).Error("Failed to revoke session after refresh token reuse", "session_id", session.ID.Hex(), "email", session.Email, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reuse detected, session revoked"})
+		return
+	case errRefreshTokenInvalid:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	newSecret, refreshToken, err := newRefreshSecret(session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate refresh token"})
+		return
+	}
+	// Only rotate if nobody else rotated the same token concurrently
+	presented := hashToken(secret)
+	filter := activeSessionFilter(session.ID)
+	filter["refresh_hash"] = presented
+	res, err := sessionCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{
+		"refresh_hash":          hashToken(newSecret),
+		"previous_refresh_hash": presented,
+		"last_seen_at":          time.Now(),
+	}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate refresh token"})
+		return
+	}
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	response, err := sessionTokenResponse(&session, refreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// RevokeUserSessions lets an admin log a user out of every device.
+func RevokeUserSessions(c *gin.Context) {
+	email := c.Param("email")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	count, err := revokeUserSessions(ctx, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditRevokeSessions,
+		TargetType: auditTargetUser,
+		Target:     email,
+		Before:     bson.M{"active_sessions": count},
+		After:      bson.M{"active_sessions": 0},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Sessions revoked", "revoked": count})
+}
+
+// SessionInfo is how a session is listed to its owner or an admin.
+type SessionInfo struct {
+	Session
+	Device  string `json:"device"`
+	Current bool   `json:"current"`
+}
+
+// describeUserAgent turns a User-Agent header into something like
+// "Chrome on Windows". It only knows the common browsers and systems.
+func describeUserAgent(ua string) string {
+	if ua == "" {
+		return "Unknown device"
+	}
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+		{"PostmanRuntime/", "Postman"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	system := ""
+	for _, o := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			system = o.name
+			break
+		}
+	}
+	if system == "" {
+		return browser
+	}
+	return browser + " on " + system
+}
+
+// listSessions returns the active sessions of a user, most recently used
+// first. Impersonation sessions are only included for admins.
+func listSessions(ctx context.Context, email, currentID string, includeImpersonation bool) ([]SessionInfo, error) {
+	filter := bson.M{
+		"email":      email,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	if !includeImpersonation {
+		filter["impersonated_by"] = bson.M{"$exists": false}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "last_seen_at", Value: -1}})
+	cursor, err := sessionCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []Session
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	list := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		list = append(list, SessionInfo{
+			Session: session,
+			Device:  describeUserAgent(session.UserAgent),
+			Current: session.ID.Hex() == currentID,
+		})
+	}
+	return list, nil
+}
+
+// revokeOneSession ends the session in :id if it belongs to email, writing
+// the response itself. Impersonation sessions are only matched for admins.
+func revokeOneSession(c *gin.Context, ctx context.Context, email string, includeImpersonation bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+	filter := activeSessionFilter(id)
+	filter["email"] = email
+	if !includeImpersonation {
+		filter["impersonated_by"] = bson.M{"$exists": false}
+	}
+	res, err := sessionCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found or already ended"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// ListMySessions lists where the caller is logged in. The session making
+// the request is marked as current.
+func ListMySessions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sessions, err := listSessions(ctx, c.GetString("email"), c.GetString("session_id"), false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// RevokeMySession logs the caller out of one of their sessions, which may
+// be the current one.
+func RevokeMySession(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	revokeOneSession(c, ctx, c.GetString("email"), false)
+}
+
+// RevokeOtherSessions logs the caller out everywhere except the session
+// making the request.
+func RevokeOtherSessions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"email":           c.GetString("email"),
+		"revoked_at":      bson.M{"$exists": false},
+		"expires_at":      bson.M{"$gt": time.Now()},
+		"impersonated_by": bson.M{"$exists": false},
+	}
+	if current, err := primitive.ObjectIDFromHex(c.GetString("session_id")); err == nil {
+		filter["_id"] = bson.M{"$ne": current}
+	}
+	res, err := sessionCollection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Other sessions revoked", "revoked": res.ModifiedCount})
+}
+
+// GetUserSessions lets an admin see where a user is logged in, including
+// impersonation sessions.
+func GetUserSessions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	sessions, err := listSessions(ctx, user.Email, c.GetString("session_id"), true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"email": user.Email, "sessions": sessions})
+}
+
+// RevokeUserSession lets an admin end one session of a user.
+func RevokeUserSession(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	revokeOneSession(c, ctx, user.Email, true)
+}
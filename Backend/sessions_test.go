@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseRefreshToken(t *testing.T) {
+	id := primitive.NewObjectID()
+	secret, token, err := newRefreshSecret(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotID, gotSecret, ok := parseRefreshToken(token)
+	if !ok || gotID != id || gotSecret != secret {
+		t.Fatalf("parseRefreshToken(%q) = %v, %q, %v, want %v, %q, true", token, gotID, gotSecret, ok, id, secret)
+	}
+
+	for _, token := range []string{
+		"",
+		secret,
+		id.Hex(),
+		id.Hex() + ".",
+		"not-an-id." + secret,
+		"." + secret,
+	} {
+		if _, _, ok := parseRefreshToken(token); ok {
+			t.Errorf("parseRefreshToken(%q) succeeded", token)
+		}
+	}
+}
+
+// rotateForTest rotates the session's refresh secret the way RefreshToken
+// does and returns the new secret.
+func rotateForTest(t *testing.T, session *Session, presented string) string {
+	t.Helper()
+	if err := checkRefreshSecret(session, presented); err != nil {
+		t.Fatalf("refreshing with %q: %v", presented, err)
+	}
+	secret, _, err := newRefreshSecret(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.PreviousRefreshHash = hashToken(presented)
+	session.RefreshHash = hashToken(secret)
+	return secret
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	session := &Session{ID: primitive.NewObjectID()}
+	first, _, err := newRefreshSecret(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.RefreshHash = hashToken(first)
+
+	if err := checkRefreshSecret(session, "guessed"); err != errRefreshTokenInvalid {
+		t.Errorf("unknown secret: %v, want errRefreshTokenInvalid", err)
+	}
+
+	second := rotateForTest(t, session, first)
+	if second == first {
+		t.Fatal("rotation kept the same secret")
+	}
+	// Whoever still holds the first token copied it, so the session must go
+	if err := checkRefreshSecret(session, first); err != errRefreshTokenReused {
+		t.Errorf("rotated secret: %v, want errRefreshTokenReused", err)
+	}
+
+	third := rotateForTest(t, session, second)
+	if err := checkRefreshSecret(session, second); err != errRefreshTokenReused {
+		t.Errorf("secret rotated once more: %v, want errRefreshTokenReused", err)
+	}
+	if err := checkRefreshSecret(session, third); err != nil {
+		t.Errorf("current secret: %v", err)
+	}
+}
+
+func TestCheckRefreshSecretNeverRotated(t *testing.T) {
+	// A fresh session has no previous secret, which must not match an empty one
+	session := &Session{ID: primitive.NewObjectID(), RefreshHash: hashToken("current")}
+	if err := checkRefreshSecret(session, ""); err != errRefreshTokenInvalid {
+		t.Errorf("empty secret: %v, want errRefreshTokenInvalid", err)
+	}
+	if err := checkRefreshSecret(session, "current"); err != nil {
+		t.Errorf("current secret: %v", err)
+	}
+}
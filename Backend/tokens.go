@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TokenService signs and verifies the access tokens handed out by Login. Several keys
+// can be valid at once so a secret can be rotated without logging everyone
+// out: new tokens are signed with the active key and carry its ID in the
+// "kid" header, while tokens signed with any other configured key keep
+// verifying until that key is removed.
+type TokenService struct {
+	keys      map[string][]byte
+	activeKID string
+	ttl       time.Duration
+}
+
+var tokens *TokenService
+
+// NewTokenServiceFromEnv builds the token service from the environment:
+//
+//	JWT_SIGNING_KEYS   comma separated "kid:secret" pairs
+//	JWT_ACTIVE_KEY_ID  kid used to sign new tokens (defaults to the first key)
+//	JWT_SECRET         single secret, used with kid "default" when
+//	                   JWT_SIGNING_KEYS is not set
+//	JWT_TTL            access token lifetime as a Go duration (defaults to 15m)
+//
+// When no key is configured a random one is generated so the server still
+// starts in development, but tokens will not survive a restart.
+func NewTokenServiceFromEnv() (*TokenService, error) {
+	s := &TokenService{keys: map[string][]byte{}, ttl: 15 * time.Minute}
+
+	if raw := os.Getenv("JWT_SIGNING_KEYS"); raw != "" {
+		for _, pair := range strings.Split(raw, ",") {
+			kid, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || kid == "" || secret == "" {
+				return nil, fmt.Errorf("invalid JWT_SIGNING_KEYS entry %q, expected kid:secret", pair)
+			}
+			if _, dup := s.keys[kid]; dup {
+				return nil, fmt.Errorf("duplicate key id %q in JWT_SIGNING_KEYS", kid)
+			}
+			s.keys[kid] = []byte(secret)
+			if s.activeKID == "" {
+				s.activeKID = kid
+			}
+		}
+	} else if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		s.keys["default"] = []byte(secret)
+		s.activeKID = "default"
+	} else {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		slog.Warn("No JWT signing key configured, using a random key; tokens will be invalid after restart")
+		s.keys["ephemeral"] = secret
+		s.activeKID = "ephemeral"
+	}
+
+	if kid := os.Getenv("JWT_ACTIVE_KEY_ID"); kid != "" {
+		if _, ok := s.keys[kid]; !ok {
+			return nil, fmt.Errorf("JWT_ACTIVE_KEY_ID %q does not match any configured key", kid)
+		}
+		s.activeKID = kid
+	}
+
+	if raw := os.Getenv("JWT_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid JWT_TTL %q", raw)
+		}
+		s.ttl = ttl
+	}
+	return s, nil
+}
+
+// Issue signs an access token for the given email and session with the
+// active key.
+func (s *TokenService) Issue(email, sessionID string) (string, time.Time, error) {
+	expirationTime := time.Now().Add(s.ttl)
+	return s.sign(Claims{Email: email, SessionID: sessionID}, expirationTime)
+}
+
+// IssueImpersonation signs a token that acts as email on behalf of the admin
+// impersonator. It expires with the impersonation session rather than after
+// the usual access token lifetime, since it cannot be refreshed.
+func (s *TokenService) IssueImpersonation(email, sessionID, impersonator string, expiresAt time.Time) (string, error) {
+	tokenString, _, err := s.sign(Claims{Email: email, SessionID: sessionID, ImpersonatedBy: impersonator}, expiresAt)
+	return tokenString, err
+}
+
+func (s *TokenService) sign(claims Claims, expirationTime time.Time) (string, time.Time, error) {
+	claims.StandardClaims = jwt.StandardClaims{
+		ExpiresAt: expirationTime.Unix(),
+		IssuedAt:  time.Now().Unix(),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = s.activeKID
+	tokenString, err := token.SignedString(s.keys[s.activeKID])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tokenString, expirationTime, nil
+}
+
+// Parse verifies the signature and expiry of a token and returns its claims.
+// Tokens without a "kid" header are checked against the active key.
+func (s *TokenService) Parse(tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		kid := s.activeKID
+		if raw, ok := token.Header["kid"]; ok {
+			kid, ok = raw.(string)
+			if !ok {
+				return nil, errors.New("invalid key id")
+			}
+		}
+		key, ok := s.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
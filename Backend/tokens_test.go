@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// setTokenEnv sets the JWT_* variables for the test, leaving out any not
+// in env.
+func setTokenEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, name := range []string{"JWT_SIGNING_KEYS", "JWT_ACTIVE_KEY_ID", "JWT_SECRET", "JWT_TTL"} {
+		t.Setenv(name, env[name])
+	}
+}
+
+// newTestTokenService builds a token service from the given JWT_* settings.
+func newTestTokenService(t *testing.T, env map[string]string) *TokenService {
+	t.Helper()
+	setTokenEnv(t, env)
+	s, err := NewTokenServiceFromEnv()
+	if err != nil {
+		t.Fatalf("NewTokenServiceFromEnv: %v", err)
+	}
+	return s
+}
+
+func tokenKID(t *testing.T, tokenString string) any {
+	t.Helper()
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.Header["kid"]
+}
+
+func TestNewTokenServiceFromEnv(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantActive string
+		wantErr    string
+	}{
+		{"first key is active", map[string]string{"JWT_SIGNING_KEYS": "k1:s1,k2:s2"}, "k1", ""},
+		{"active key chosen", map[string]string{"JWT_SIGNING_KEYS": "k1:s1, k2:s2", "JWT_ACTIVE_KEY_ID": "k2"}, "k2", ""},
+		{"single secret", map[string]string{"JWT_SECRET": "s"}, "default", ""},
+		{"keys win over single secret", map[string]string{"JWT_SIGNING_KEYS": "k1:s1", "JWT_SECRET": "s"}, "k1", ""},
+		{"nothing configured", map[string]string{}, "ephemeral", ""},
+		{"unknown active key", map[string]string{"JWT_SIGNING_KEYS": "k1:s1", "JWT_ACTIVE_KEY_ID": "k9"}, "", "does not match"},
+		{"entry without secret", map[string]string{"JWT_SIGNING_KEYS": "k1:"}, "", "expected kid:secret"},
+		{"entry without kid", map[string]string{"JWT_SIGNING_KEYS": "s1"}, "", "expected kid:secret"},
+		{"duplicate kid", map[string]string{"JWT_SIGNING_KEYS": "k1:s1,k1:s2"}, "", "duplicate key id"},
+		{"invalid TTL", map[string]string{"JWT_SECRET": "s", "JWT_TTL": "soon"}, "", "invalid JWT_TTL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTokenEnv(t, tt.env)
+			s, err := NewTokenServiceFromEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewTokenServiceFromEnv() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.activeKID != tt.wantActive {
+				t.Errorf("active key = %q, want %q", s.activeKID, tt.wantActive)
+			}
+		})
+	}
+}
+
+func TestTokenServiceKeyRotation(t *testing.T) {
+	old := newTestTokenService(t, map[string]string{"JWT_SIGNING_KEYS": "2024:old-secret"})
+	oldToken, _, err := old.Issue("student@example.com", "session-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := tokenKID(t, oldToken); kid != "2024" {
+		t.Errorf("kid = %v, want 2024", kid)
+	}
+
+	// A new active key is added; tokens signed with the old one still verify
+	rotated := newTestTokenService(t, map[string]string{"JWT_SIGNING_KEYS": "2024:old-secret,2025:new-secret", "JWT_ACTIVE_KEY_ID": "2025"})
+	newToken, _, err := rotated.Issue("student@example.com", "session-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := tokenKID(t, newToken); kid != "2025" {
+		t.Errorf("kid = %v, want 2025", kid)
+	}
+	for _, tokenString := range []string{oldToken, newToken} {
+		claims, err := rotated.Parse(tokenString)
+		if err != nil {
+			t.Fatalf("Parse after rotation: %v", err)
+		}
+		if claims.Email != "student@example.com" {
+			t.Errorf("Email = %q", claims.Email)
+		}
+	}
+
+	// Once the old key is removed its tokens stop verifying
+	retired := newTestTokenService(t, map[string]string{"JWT_SIGNING_KEYS": "2025:new-secret"})
+	if _, err := retired.Parse(oldToken); err == nil {
+		t.Error("token signed with a removed key still verifies")
+	}
+	if _, err := retired.Parse(newToken); err != nil {
+		t.Errorf("Parse with the active key: %v", err)
+	}
+}
+
+func TestTokenServiceParse(t *testing.T) {
+	s := newTestTokenService(t, map[string]string{"JWT_SIGNING_KEYS": "a:secret-a,b:secret-b"})
+	sign := func(kid any, key string, method jwt.SigningMethod, expires time.Time) string {
+		t.Helper()
+		token := jwt.NewWithClaims(method, Claims{
+			Email:          "student@example.com",
+			StandardClaims: jwt.StandardClaims{ExpiresAt: expires.Unix()},
+		})
+		if kid != nil {
+			token.Header["kid"] = kid
+		}
+		var signingKey any = []byte(key)
+		if method == jwt.SigningMethodNone {
+			signingKey = jwt.UnsafeAllowNoneSignatureType
+		}
+		tokenString, err := token.SignedString(signingKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenString
+	}
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"active key", sign("a", "secret-a", jwt.SigningMethodHS256, later), true},
+		{"other configured key", sign("b", "secret-b", jwt.SigningMethodHS256, later), true},
+		{"no kid uses the active key", sign(nil, "secret-a", jwt.SigningMethodHS256, later), true},
+		{"no kid signed with another key", sign(nil, "secret-b", jwt.SigningMethodHS256, later), false},
+		{"kid does not match the key", sign("a", "secret-b", jwt.SigningMethodHS256, later), false},
+		{"unknown kid", sign("c", "secret-a", jwt.SigningMethodHS256, later), false},
+		{"kid not a string", sign(7, "secret-a", jwt.SigningMethodHS256, later), false},
+		{"alg none", sign("a", "", jwt.SigningMethodNone, later), false},
+		{"expired", sign("a", "secret-a", jwt.SigningMethodHS256, time.Now().Add(-time.Minute)), false},
+		{"garbage", "not.a.token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Parse(tt.token)
+			if tt.valid && err != nil {
+				t.Errorf("Parse() = %v, want success", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("Parse() succeeded, want an error")
+			}
+		})
+	}
+}
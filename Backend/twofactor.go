@@ -0,0 +1,703 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TwoFactor is a user's TOTP (RFC 6238) enrollment. Setup stores a pending
+// secret that only becomes active once the user proves their authenticator
+// app produces codes for it.
+type TwoFactor struct {
+	Email              string     `bson:"email"`
+	Secret             string     `bson:"secret,omitempty"`
+	PendingSecret      string     `bson:"pending_secret,omitempty"`
+	Enabled            bool       `bson:"enabled"`
+	RecoveryCodeHashes []string   `bson:"recovery_codes,omitempty"`
+	LastUsedStep       int64      `bson:"last_used_step"`
+	EnabledAt          *time.Time `bson:"enabled_at,omitempty"`
+}
+
+// LoginChallenge is handed out by Login after the password checks out when
+// a second factor is still needed. It is only good for the /login/2fa
+// endpoints, never as an access token.
+type LoginChallenge struct {
+	TokenHash string    `bson:"token_hash"`
+	Email     string    `bson:"email"`
+	Attempts  int       `bson:"attempts"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+var (
+	twoFactorCollection      *mongo.Collection
+	loginChallengeCollection *mongo.Collection
+)
+
+// Settings, overridable through TWO_FACTOR_ISSUER and
+// TWO_FACTOR_REQUIRED_ROLES (a comma separated list such as "admin").
+var (
+	twoFactorIssuer        = "Learning Management System"
+	twoFactorRequiredRoles = map[string]bool{}
+)
+
+const (
+	totpDigits            = 6
+	totpPeriod            = 30
+	totpSkew              = 1 // steps accepted either side of now
+	recoveryCodeCount     = 10
+	loginChallengeTTL     = 5 * time.Minute
+	loginChallengeRetries = 5
+)
+
+var (
+	errTwoFactorInvalid      = errors.New("invalid two-factor code")
+	errTwoFactorEnabled      = errors.New("two-factor authentication already enabled")
+	errTwoFactorNotPending   = errors.New("no two-factor setup in progress")
+	errLoginChallengeInvalid = errors.New("invalid or expired login challenge")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// initTwoFactor reads the settings and creates the two_factor and
+// login_challenges indexes.
+func initTwoFactor(ctx context.Context) error {
+	if issuer := os.Getenv("TWO_FACTOR_ISSUER"); issuer != "" {
+		twoFactorIssuer = issuer
+	}
+	if raw := os.Getenv("TWO_FACTOR_REQUIRED_ROLES"); raw != "" {
+		for _, role := range strings.Split(raw, ",") {
+			role = strings.TrimSpace(role)
+			if !validRole(role) {
+				return fmt.Errorf("invalid TWO_FACTOR_REQUIRED_ROLES %q", raw)
+			}
+			twoFactorRequiredRoles[role] = true
+		}
+	}
+	if _, err := twoFactorCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return err
+	}
+	_, err := loginChallengeCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// totpCode computes the code for a time step (RFC 4226 dynamic truncation).
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// matchTOTP returns the time step a code belongs to, allowing for clock
+// skew, and whether it matched at all.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func otpauthURI(email, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", twoFactorIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(twoFactorIssuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// normalizeRecoveryCode lets users type recovery codes with or without the
+// dash and in any case.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// newRecoveryCodes returns fresh codes to show the user once and the hashes
+// to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(code)
+	}
+	return codes, hashes, nil
+}
+
+// loadTwoFactor returns the user's enrollment, or nil if they never started
+// one.
+func loadTwoFactor(ctx context.Context, email string) (*TwoFactor, error) {
+	var tf TwoFactor
+	err := twoFactorCollection.FindOne(ctx, bson.M{"email": email}).Decode(&tf)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tf, nil
+}
+
+// twoFactorRequired reports whether the user must use 2FA, either because an
+// admin required it for them or because of their role.
+func twoFactorRequired(user User) bool {
+	return user.TwoFactorRequired || twoFactorRequiredRoles[user.Role]
+}
+
+// verifySecondFactor checks a TOTP code or, failing that, a recovery code,
+// which is used up. A TOTP code is only accepted once.
+func verifySecondFactor(ctx context.Context, tf *TwoFactor, code, recoveryCode string) error {
+	if !tf.Enabled {
+		return errTwoFactorInvalid
+	}
+	if code != "" {
+		step, ok := matchTOTP(tf.Secret, code, time.Now())
+		if !ok {
+			return errTwoFactorInvalid
+		}
+		// Only move forward in time so a code cannot be replayed
+		result, err := twoFactorCollection.UpdateOne(ctx,
+			bson.M{"email": tf.Email, "last_used_step": bson.M{"$lt": step}},
+			bson.M{"$set": bson.M{"last_used_step": step}})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			return errTwoFactorInvalid
+		}
+		return nil
+	}
+	if recoveryCode != "" {
+		hash := hashToken(normalizeRecoveryCode(recoveryCode))
+		result, err := twoFactorCollection.UpdateOne(ctx,
+			bson.M{"email": tf.Email, "recovery_codes": hash},
+			bson.M{"$pull": bson.M{"recovery_codes": hash}})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			return errTwoFactorInvalid
+		}
+		return nil
+	}
+	return errTwoFactorInvalid
+}
+
+// beginTwoFactorSetup stores a new pending secret for the user.
+func beginTwoFactorSetup(ctx context.Context, email string) (string, error) {
+	tf, err := loadTwoFactor(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	if tf != nil && tf.Enabled {
+		return "", errTwoFactorEnabled
+	}
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	secret := totpEncoding.EncodeToString(raw)
+	_, err = twoFactorCollection.UpdateOne(ctx,
+		bson.M{"email": email},
+		bson.M{"$set": bson.M{"pending_secret": secret, "enabled": false}},
+		options.Update().SetUpsert(true))
+	return secret, err
+}
+
+// confirmTwoFactorSetup enables 2FA once code matches the pending secret and
+// returns the user's recovery codes.
+func confirmTwoFactorSetup(ctx context.Context, email, code string) ([]string, error) {
+	tf, err := loadTwoFactor(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if tf == nil || tf.PendingSecret == "" {
+		return nil, errTwoFactorNotPending
+	}
+	step, ok := matchTOTP(tf.PendingSecret, code, time.Now())
+	if !ok {
+		return nil, errTwoFactorInvalid
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	result, err := twoFactorCollection.UpdateOne(ctx,
+		bson.M{"email": email, "pending_secret": tf.PendingSecret},
+		bson.M{
+			"$set": bson.M{
+				"secret":         tf.PendingSecret,
+				"enabled":        true,
+				"recovery_codes": hashes,
+				"last_used_step": step,
+				"enabled_at":     now,
+			},
+			"$unset": bson.M{"pending_secret": ""},
+		})
+	if err != nil {
+		return nil, err
+	}
+	if result.ModifiedCount == 0 {
+		return nil, errTwoFactorNotPending
+	}
+	return codes, nil
+}
+
+// startLoginChallenge issues the token a client needs for the second login
+// step.
+func startLoginChallenge(ctx context.Context, email string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := fmt.Sprintf("%x", raw)
+	_, err := loginChallengeCollection.InsertOne(ctx, LoginChallenge{
+		TokenHash: hashToken(token),
+		Email:     email,
+		ExpiresAt: time.Now().Add(loginChallengeTTL),
+	})
+	return token, err
+}
+
+// useLoginChallenge counts an attempt against a challenge and returns the
+// email it was issued to.
+func useLoginChallenge(ctx context.Context, token string) (string, error) {
+	var challenge LoginChallenge
+	err := loginChallengeCollection.FindOneAndUpdate(ctx,
+		bson.M{
+			"token_hash": hashToken(token),
+			"expires_at": bson.M{"$gt": time.Now()},
+			"attempts":   bson.M{"$lt": loginChallengeRetries},
+		},
+		bson.M{"$inc": bson.M{"attempts": 1}}).Decode(&challenge)
+	if err == mongo.ErrNoDocuments {
+		return "", errLoginChallengeInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	return challenge.Email, nil
+}
+
+func endLoginChallenge(ctx context.Context, token string) {
+	loginChallengeCollection.DeleteOne(ctx, bson.M{"token_hash": hashToken(token)})
+}
+
+// loadChallengeUser resolves the challenge token of a /login/2fa request,
+// writing the error response itself when that fails.
+func loadChallengeUser(c *gin.Context, ctx context.Context, challengeToken string) (User, bool) {
+	email, err := useLoginChallenge(ctx, challengeToken)
+	if err != nil {
+		if err == errLoginChallengeInvalid {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, please sign in again"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify login"})
+		}
+		return User{}, false
+	}
+	user, err := findUserByEmail(ctx, email)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, please sign in again"})
+		return User{}, false
+	}
+	return user, true
+}
+
+// LoginSecondFactor finishes a login with a TOTP code or a recovery code.
+func LoginSecondFactor(c *gin.Context) {
+	var input struct {
+		ChallengeToken string `json:"challengeToken"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recoveryCode"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.ChallengeToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadChallengeUser(c, ctx, input.ChallengeToken)
+	if !ok {
+		return
+	}
+	if !throttleLogin(c, ctx, user.Email) {
+		return
+	}
+	tf, err := loadTwoFactor(ctx, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor settings"})
+		return
+	}
+	if tf == nil || !tf.Enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor setup required", "twoFactorSetupRequired": true})
+		return
+	}
+	if err := verifySecondFactor(ctx, tf, input.Code, input.RecoveryCode); err != nil {
+		if err != errTwoFactorInvalid {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+			return
+		}
+		// Wrong codes count towards the account lockout like wrong passwords
+		loginFailed(c, ctx, user.Email)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+		return
+	}
+	endLoginChallenge(ctx, input.ChallengeToken)
+	loginSucceeded(ctx, user.Email)
+
+	response, ok := startLoginSession(c, ctx, user.Email)
+	if !ok {
+		return
+	}
+	if input.Code == "" {
+		remaining, err := loadTwoFactor(ctx, user.Email)
+		if err == nil && remaining != nil {
+			response["recoveryCodesRemaining"] = len(remaining.RecoveryCodeHashes)
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// LoginTwoFactorSetup starts enrollment during login for users who are
+// required to use 2FA but have not set it up yet.
+func LoginTwoFactorSetup(c *gin.Context) {
+	var input struct {
+		ChallengeToken string `json:"challengeToken"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.ChallengeToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadChallengeUser(c, ctx, input.ChallengeToken)
+	if !ok {
+		return
+	}
+	respondTwoFactorSetup(c, ctx, user.Email)
+}
+
+// LoginTwoFactorConfirm completes enrollment during login and signs the
+// user in.
+func LoginTwoFactorConfirm(c *gin.Context) {
+	var input struct {
+		ChallengeToken string `json:"challengeToken"`
+		Code           string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.ChallengeToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadChallengeUser(c, ctx, input.ChallengeToken)
+	if !ok {
+		return
+	}
+	codes, ok := confirmTwoFactor(c, ctx, user.Email, input.Code)
+	if !ok {
+		return
+	}
+	endLoginChallenge(ctx, input.ChallengeToken)
+	loginSucceeded(ctx, user.Email)
+
+	response, ok := startLoginSession(c, ctx, user.Email)
+	if !ok {
+		return
+	}
+	response["recoveryCodes"] = codes
+	c.JSON(http.StatusOK, response)
+}
+
+func respondTwoFactorSetup(c *gin.Context, ctx context.Context, email string) {
+	secret, err := beginTwoFactorSetup(ctx, email)
+	if err != nil {
+		if err == errTwoFactorEnabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor setup"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret":     secret,
+		"otpauthUri": otpauthURI(email, secret),
+		"message":    "Add the key to your authenticator app, then confirm with a code from it",
+	})
+}
+
+// confirmTwoFactor wraps confirmTwoFactorSetup, writing the error response
+// itself when that fails.
+func confirmTwoFactor(c *gin.Context, ctx context.Context, email, code string) ([]string, bool) {
+	codes, err := confirmTwoFactorSetup(ctx, email, code)
+	switch err {
+	case nil:
+		return codes, true
+	case errTwoFactorNotPending:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start two-factor setup first"})
+	case errTwoFactorInvalid:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+	}
+	return nil, false
+}
+
+// GetTwoFactorStatus tells the caller whether 2FA is enabled and required.
+func GetTwoFactorStatus(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := findUserByEmail(ctx, c.GetString("email"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	tf, err := loadTwoFactor(ctx, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor settings"})
+		return
+	}
+	status := gin.H{"enabled": false, "required": twoFactorRequired(user)}
+	if tf != nil && tf.Enabled {
+		status["enabled"] = true
+		status["enabledAt"] = tf.EnabledAt
+		status["recoveryCodesRemaining"] = len(tf.RecoveryCodeHashes)
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// SetupTwoFactor starts enrollment for the caller.
+func SetupTwoFactor(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	respondTwoFactorSetup(c, ctx, c.GetString("email"))
+}
+
+// ConfirmTwoFactor enables 2FA for the caller and returns recovery codes.
+func ConfirmTwoFactor(c *gin.Context) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	codes, ok := confirmTwoFactor(c, ctx, c.GetString("email"), input.Code)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Two-factor authentication enabled. Store the recovery codes somewhere safe.",
+		"recoveryCodes": codes,
+	})
+}
+
+// DisableTwoFactor turns 2FA off for the caller after checking a current
+// code. Users it is required for cannot turn it off.
+func DisableTwoFactor(c *gin.Context) {
+	var input struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := findUserByEmail(ctx, c.GetString("email"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if twoFactorRequired(user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for your account"})
+		return
+	}
+	tf, err := loadTwoFactor(ctx, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor settings"})
+		return
+	}
+	if tf == nil || !tf.Enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if err := verifySecondFactor(ctx, tf, input.Code, input.RecoveryCode); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+		return
+	}
+	if _, err := twoFactorCollection.DeleteOne(ctx, bson.M{"email": user.Email}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes.
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	email := c.GetString("email")
+	tf, err := loadTwoFactor(ctx, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor settings"})
+		return
+	}
+	if tf == nil || !tf.Enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if err := verifySecondFactor(ctx, tf, input.Code, ""); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+	if _, err := twoFactorCollection.UpdateOne(ctx, bson.M{"email": email}, bson.M{"$set": bson.M{"recovery_codes": hashes}}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save recovery codes"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// SetTwoFactorRequired lets an admin require 2FA for a user, or lift that.
+// Users it is required for must enroll at their next login.
+func SetTwoFactorRequired(c *gin.Context) {
+	var input struct {
+		Required bool `json:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	update := bson.M{"$set": bson.M{"two_factor_required": true}}
+	if !input.Required {
+		update = bson.M{"$unset": bson.M{"two_factor_required": ""}}
+	}
+	if _, err := userCollection.UpdateOne(ctx, bson.M{"email": user.Email}, update); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditRequire2FA,
+		TargetType: auditTargetUser,
+		Target:     user.Email,
+		Before:     bson.M{"two_factor_required": user.TwoFactorRequired},
+		After:      bson.M{"two_factor_required": input.Required},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor requirement updated", "required": input.Required})
+}
+
+// ResetTwoFactor removes a user's enrollment, for when they lost both their
+// device and recovery codes. Their sessions are revoked as well.
+func ResetTwoFactor(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	result, err := twoFactorCollection.DeleteOne(ctx, bson.M{"email": user.Email})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset two-factor authentication"})
+		return
+	}
+	revoked, err := revokeUserSessions(ctx, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditReset2FA,
+		TargetType: auditTargetUser,
+		Target:     user.Email,
+		Before:     bson.M{"two_factor_enrolled": result.DeletedCount > 0},
+		After:      bson.M{"two_factor_enrolled": false, "revoked_sessions": revoked},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication reset"})
+}
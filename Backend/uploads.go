@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Only course material under uploads/courses is served to anyone. Profile
+// photos and assignment submissions belong to one user and go through the
+// handlers below, which check who is asking.
+
+// GetMyPhoto returns the logged in user's profile photo.
+func GetMyPhoto(c *gin.Context) {
+	servePhoto(c, c.GetString("email"))
+}
+
+// GetUserPhoto is the admin variant of GetMyPhoto for the user in :email.
+func GetUserPhoto(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	servePhoto(c, user.Email)
+}
+
+func servePhoto(c *gin.Context, email string) {
+	serveUpload(c, uploadPath(sanitizeEmail(email), "photo.jpg"), "Profile photo not found")
+}
+
+// GetSubmissionFile returns a file a student submitted for an assignment.
+// Students may read their own submissions; admins and the course's staff
+// with access to submissions may read everyone's.
+func GetSubmissionFile(c *gin.Context) {
+	student := c.Param("student")
+	course := c.Param("course")
+	assignment := c.Param("assignment")
+	file := c.Param("file")
+	if !safePathSegment(student) || !safePathSegment(course) || !safePathSegment(assignment) || !safePathSegment(file) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid student, course, assignment or file name"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, ok := currentUser(c, ctx)
+	if !ok {
+		return
+	}
+	if user.Username != student {
+		allowed, err := hasCoursePermission(ctx, user, course, permSubmissionsRead)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load course permissions"})
+			return
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Insufficient permissions"})
+			return
+		}
+	}
+	serveUpload(c, uploadPath("students", student, course, "assignments", assignment, file), "Submission not found")
+}
+
+// serveUpload sends a stored file, or a 404 with notFound if there is none.
+func serveUpload(c *gin.Context, path, notFound string) {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+		return
+	}
+	// Private files must not linger in shared caches
+	c.Header("Cache-Control", "private, no-cache")
+	c.File(path)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errAccountDeactivated = errors.New("account deactivated")
+
+// UserSummary is how accounts are shown to admins, without credentials.
+type UserSummary struct {
+	Username              string     `json:"username"`
+	Email                 string     `json:"email"`
+	Role                  string     `json:"role"`
+	Verified              bool       `json:"verified"`
+	Active                bool       `json:"active"`
+	PasswordResetRequired bool       `json:"password_reset_required"`
+	DeactivatedAt         *time.Time `json:"deactivated_at,omitempty"`
+}
+
+func summarizeUser(user User) UserSummary {
+	return UserSummary{
+		Username:              user.Username,
+		Email:                 user.Email,
+		Role:                  user.Role,
+		Verified:              user.Status != userStatusPendingVerification,
+		Active:                user.DeactivatedAt == nil,
+		PasswordResetRequired: user.PasswordResetRequired,
+		DeactivatedAt:         user.DeactivatedAt,
+	}
+}
+
+// checkAccountActive returns errAccountDeactivated if an admin has
+// deactivated the account, or mongo.ErrNoDocuments if it no longer exists.
+func checkAccountActive(ctx context.Context, email string) error {
+	var user User
+	err := userCollection.FindOne(ctx, bson.M{"email": email},
+		options.FindOne().SetProjection(bson.M{"deactivated_at": 1})).Decode(&user)
+	if err != nil {
+		return err
+	}
+	if user.DeactivatedAt != nil {
+		return errAccountDeactivated
+	}
+	return nil
+}
+
+// loadTargetUser loads the user named by the :email parameter, writing the
+// error response itself when that fails.
+func loadTargetUser(c *gin.Context, ctx context.Context) (User, bool) {
+	user, err := findUserByEmail(ctx, c.Param("email"))
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return user, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return user, false
+	}
+	return user, true
+}
+
+// currentUser loads the user authenticated by AuthMiddleware, writing the
+// error response itself when that fails.
+func currentUser(c *gin.Context, ctx context.Context) (User, bool) {
+	user, err := findUserByEmail(ctx, c.GetString("email"))
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: User not found"})
+		return user, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return user, false
+	}
+	return user, true
+}
+
+// safePathSegment reports whether a name can be used as one directory level
+// under uploads without pointing anywhere else.
+func safePathSegment(name string) bool {
+	return name != "" && name != "." && name != ".." && name == filepath.Base(name) && !strings.ContainsAny(name, `/\`)
+}
+
+// isSelf reports whether user is the admin making the request. Admins may
+// not demote, deactivate or delete themselves so there is always one left.
+func isSelf(c *gin.Context, user User) bool {
+	return strings.EqualFold(c.GetString("email"), user.Email)
+}
+
+// ListUsers returns a page of accounts sorted by username. Filters:
+// ?role=, ?verified=true|false, ?active=true|false and ?q= matching part of
+// the username or email. Pages are chosen with ?page= (from 1) and ?limit=.
+func ListUsers(c *gin.Context) {
+	filter := bson.M{}
+	if role := c.Query("role"); role != "" {
+		filter["role"] = role
+	}
+	switch c.Query("verified") {
+	case "true":
+		filter["status"] = bson.M{"$ne": userStatusPendingVerification}
+	case "false":
+		filter["status"] = userStatusPendingVerification
+	case "":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "verified must be true or false"})
+		return
+	}
+	switch c.Query("active") {
+	case "true":
+		filter["deactivated_at"] = bson.M{"$exists": false}
+	case "false":
+		filter["deactivated_at"] = bson.M{"$exists": true}
+	case "":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "active must be true or false"})
+		return
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := bson.M{"$regex": regexp.QuoteMeta(q), "$options": "i"}
+		filter["$or"] = bson.A{bson.M{"username": pattern}, bson.M{"email": pattern}}
+	}
+
+	page, limit := int64(1), int64(50)
+	if raw := c.Query("page"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "page must be a positive number"})
+			return
+		}
+		page = n
+	}
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 || n > 200 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	total, err := userCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count users"})
+		return
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "username", Value: 1}}).
+		SetSkip((page - 1) * limit).
+		SetLimit(limit).
+		SetProjection(bson.M{"password": 0, "otp": 0})
+	cursor, err := userCollection.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+	var users []User
+	if err := cursor.All(ctx, &users); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse users"})
+		return
+	}
+	summaries := []UserSummary{}
+	for _, user := range users {
+		summaries = append(summaries, summarizeUser(user))
+	}
+	c.JSON(http.StatusOK, gin.H{"users": summaries, "total": total, "page": page, "limit": limit})
+}
+
+// GetUser returns one account.
+func GetUser(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	courses, err := staffCourses(ctx, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load course permissions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": summarizeUser(user), "courses": courses})
+}
+
+// DeactivateUser blocks an account: its sessions are revoked and
+// AuthMiddleware and Login refuse it until it is reactivated.
+func DeactivateUser(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	if isSelf(c, user) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot deactivate your own account"})
+		return
+	}
+	_, err := userCollection.UpdateOne(ctx,
+		bson.M{"email": user.Email, "deactivated_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"deactivated_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate user"})
+		return
+	}
+	revoked, err := revokeUserSessions(ctx, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditDeactivateUser,
+		TargetType: auditTargetUser,
+		Target:     user.Email,
+		Before:     bson.M{"deactivated": user.DeactivatedAt != nil},
+		After:      bson.M{"deactivated": true, "revoked_sessions": revoked},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "User deactivated"})
+}
+
+// ReactivateUser lifts a deactivation.
+func ReactivateUser(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	_, err := userCollection.UpdateOne(ctx, bson.M{"email": user.Email}, bson.M{"$unset": bson.M{"deactivated_at": ""}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reactivate user"})
+		return
+	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditReactivateUser,
+		TargetType: auditTargetUser,
+		Target:     user.Email,
+		Before:     bson.M{"deactivated": user.DeactivatedAt != nil},
+		After:      bson.M{"deactivated": false},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "User reactivated"})
+}
+
+// ForcePasswordReset logs the user out everywhere, revokes their API tokens
+// and makes Login refuse the current password until it is changed through
+// the reset flow. A reset code is emailed right away.
+func ForcePasswordReset(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	_, err := userCollection.UpdateOne(ctx, bson.M{"email": user.Email}, bson.M{"$set": bson.M{"password_reset_required": true}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to require password reset"})
+		return
+	}
+	revokedSessions, err := revokeUserSessions(ctx, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	revokedTokens, err := revokeUserAPITokens(ctx, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API tokens"})
+		return
+	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditForcePassword,
+		TargetType: auditTargetUser,
+		Target:     user.Email,
+		Before:     bson.M{"password_reset_required": user.PasswordResetRequired},
+		After: bson.M{
+			"password_reset_required": true,
+			"revoked_sessions":        revokedSessions,
+			"revoked_api_tokens":      revokedTokens,
+		},
+	})
+
+	// A code sent moments ago is still valid, so a cooldown is not an error
+	emailSent := false
+	otp, err := issueOTP(ctx, user.Email, otpPurposeResetPassword)
+	if err == nil {
+		if err := SendOTP(ctx, user.Email, otp, otpPurposeResetPassword); err != nil {
+			discardOTP(ctx, user.Email, otpPurposeResetPassword)
+			requestLog(c).Error("Password reset email not queued", "email", user.Email, "error", err)
+		} else {
+			emailSent = true
+		}
+	} else if err != errOTPCooldown {
+		requestLog(c).Error("Failed to issue password reset OTP", "email", user.Email, "error", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset required", "emailSent": emailSent})
+}
+
+// DeleteUser permanently removes an account and everything that belongs to
+// it: details, leaderboard entry, quiz and assignment submissions, course
+// staff assignments, sessions, API tokens and uploaded files. The user document goes
+// last so a failed delete can simply be retried.
+func DeleteUser(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	user, ok := loadTargetUser(c, ctx)
+	if !ok {
+		return
+	}
+	if isSelf(c, user) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot delete your own account"})
+		return
+	}
+
+	cleanups := []struct {
+		what string
+		run  func() error
+	}{
+		{"leaderboard entry", func() error {
+			_, err := leaderboardCollection.DeleteMany(ctx, bson.M{"username": user.Username})
+			return err
+		}},
+		{"quiz submissions", func() error {
+			// One document per quiz holds every student's submission
+			_, err := submissionCollection.UpdateMany(ctx,
+				bson.M{"submissions.studentId": user.Email},
+				bson.M{"$pull": bson.M{"submissions": bson.M{"studentId": user.Email}}})
+			return err
+		}},
+		{"assignment submissions", func() error {
+			_, err := assignmentsCollection.UpdateMany(ctx,
+				bson.M{"submissions.student": user.Username},
+				bson.M{"$pull": bson.M{"submissions": bson.M{"student": user.Username}}})
+			return err
+		}},
+		{"details", func() error {
+			_, err := detailsCollection.DeleteMany(ctx, bson.M{"email": user.Email})
+			return err
+		}},
+		{"course staff assignments", func() error {
+			_, err := courseStaffCollection.DeleteMany(ctx, bson.M{"email": user.Email})
+			return err
+		}},
+		{"sessions", func() error {
+			_, err := sessionCollection.DeleteMany(ctx, bson.M{"email": user.Email})
+			return err
+		}},
+		{"API tokens", func() error {
+			_, err := apiTokenCollection.DeleteMany(ctx, bson.M{"email": user.Email})
+			return err
+		}},
+		{"two-factor settings", func() error {
+			_, err := twoFactorCollection.DeleteMany(ctx, bson.M{"email": user.Email})
+			return err
+		}},
+		{"OTPs", func() error {
+			_, err := otpCollection.DeleteMany(ctx, bson.M{"email": user.Email})
+			return err
+		}},
+		{"password reset tokens", func() error {
+			_, err := passwordResetCollection.DeleteMany(ctx, bson.M{"email": user.Email})
+			return err
+		}},
+		{"login attempts", func() error {
+			_, err := loginAttemptCollection.DeleteMany(ctx, bson.M{"key": loginEmailKey(user.Email)})
+			return err
+		}},
+		{"uploaded files", func() error {
+			if err := os.RemoveAll(uploadPath(sanitizeEmail(user.Email))); err != nil {
+				return err
+			}
+			// Usernames come from sign-up, so never let one point outside uploads/students
+			if !safePathSegment(user.Username) {
+				return nil
+			}
+			return os.RemoveAll(uploadPath("students", user.Username))
+		}},
+	}
+	for _, cleanup := range cleanups {
+		if err := cleanup.run(); err != nil {
+			requestLog(c).Error("Failed to delete user data", "email", user.Email, "what", cleanup.what, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete " + cleanup.what})
+			return
+		}
+	}
+
+	if _, err := userCollection.DeleteOne(ctx, bson.M{"email": user.Email}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		return
+	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditDeleteUser,
+		TargetType: auditTargetUser,
+		Target:     user.Email,
+		Before:     bson.M{"username": user.Username, "role": user.Role, "status": user.Status},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "User and their data deleted"})
+}
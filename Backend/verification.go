@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Verification states. Users created before verification existed have no
+// status and are treated as verified. Deactivation is tracked separately in
+// User.DeactivatedAt.
+const (
+	userStatusPendingVerification = "pending_verification"
+	userStatusActive              = "active"
+)
+
+// caseInsensitive compares strings ignoring case. Lookups of usernames and
+// emails use it so they match the unique indexes created in initUserIndexes.
+var caseInsensitive = &options.Collation{Locale: "en", Strength: 2}
+
+// initUserIndexes enforces case-insensitive uniqueness of usernames and
+// emails. Existing duplicates make index creation fail; that is logged
+// rather than fatal so the server can still start while they are cleaned up.
+func initUserIndexes(ctx context.Context) {
+	_, err := userCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true).SetCollation(caseInsensitive)},
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true).SetCollation(caseInsensitive)},
+	})
+	if err != nil {
+		slog.Warn("Could not create unique user indexes, check for duplicate usernames or emails", "error", err)
+	}
+}
+
+// normalizeEmail validates a bare email address and returns it lowercased.
+func normalizeEmail(email string) (string, bool) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return "", false
+	}
+	return email, true
+}
+
+// findUserByEmail looks up a user ignoring the case of the email.
+func findUserByEmail(ctx context.Context, email string) (User, error) {
+	var user User
+	err := userCollection.FindOne(ctx, bson.M{"email": strings.TrimSpace(email)},
+		options.FindOne().SetCollation(caseInsensitive)).Decode(&user)
+	return user, err
+}
+
+// sendVerificationEmail issues a verify_email OTP and queues it.
+func sendVerificationEmail(ctx context.Context, user User) error {
+	otp, err := issueOTP(ctx, user.Email, otpPurposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+	err = enqueueEmail(ctx, emailVerifyEmail, gin.H{
+		"Username":         user.Username,
+		"OTP":              otp,
+		"ExpiresInMinutes": int(otpTTL.Minutes()),
+	}, user.Email)
+	if err != nil {
+		discardOTP(ctx, user.Email, otpPurposeVerifyEmail)
+	}
+	return err
+}
+
+// VerifyEmail activates a pending account with the OTP sent at registration.
+func VerifyEmail(c *gin.Context) {
+	var input struct {
+		Email string `json:"email"`
+		OTP   string `json:"otp"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := findUserByEmail(ctx, input.Email)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid OTP"})
+		return
+	}
+	if user.Status != userStatusPendingVerification {
+		c.JSON(http.StatusOK, gin.H{"message": "Email already verified"})
+		return
+	}
+	if err := verifyOTP(ctx, user.Email, otpPurposeVerifyEmail, input.OTP); err != nil {
+		switch err {
+		case errOTPInvalid:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid OTP"})
+		case errOTPExpired:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "OTP expired, please request a new one"})
+		case errOTPTooManyAttempts:
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, please request a new OTP"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify OTP"})
+		}
+		return
+	}
+
+	_, err = userCollection.UpdateOne(ctx, bson.M{"email": user.Email}, bson.M{"$set": bson.M{"status": userStatusActive}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Email verified successfully!"})
+}
+
+// ResendVerificationEmail sends a new verification OTP to a pending account.
+// It answers the same way for unknown or verified emails.
+func ResendVerificationEmail(c *gin.Context) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := findUserByEmail(ctx, input.Email)
+	if err == nil && user.Status == userStatusPendingVerification {
+		if err := sendVerificationEmail(ctx, user); err != nil {
+			if err == errOTPCooldown {
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": "OTP already sent, please wait before requesting another"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send OTP"})
+			}
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "If the account is awaiting verification, a new OTP has been sent"})
+}
+
+// AdminVerifyUser marks an account as verified without an OTP.
+func AdminVerifyUser(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var previous User
+	err := userCollection.FindOneAndUpdate(ctx, bson.M{"email": c.Param("email")},
+		bson.M{"$set": bson.M{"status": userStatusActive}},
+		options.FindOneAndUpdate().SetCollation(caseInsensitive)).Decode(&previous)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify user"})
+		return
+	}
+	recordAudit(ctx, c, AuditEvent{
+		Action:     auditVerifyUser,
+		TargetType: auditTargetUser,
+		Target:     previous.Email,
+		Before:     bson.M{"status": previous.Status},
+		After:      bson.M{"status": userStatusActive},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "User marked as verified"})
+}
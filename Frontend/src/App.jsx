@@ -2,6 +2,7 @@ import React from "react";
 import { BrowserRouter as Router, Routes, Route } from 'react-router-dom';
 import Login from './Pages/auth/Login';
 import Signup from './Pages/auth/Signup';
+import SetPassword from './Pages/auth/SetPassword';
 import Dashboard from "./Pages/dashboard/Dashboard";
 import Course from './Pages/courses/course';
 import Assignment from "./Pages/assiginment/assignment";
@@ -26,6 +27,7 @@ const App = () => {
                     {/* Public-only routes (blocked if already logged in) */}
                     <Route path="/login" element={<PublicRoute><Login /></PublicRoute>} />
                     <Route path="/signup" element={<PublicRoute><Signup /></PublicRoute>} />
+                    <Route path="/set-password" element={<PublicRoute><SetPassword /></PublicRoute>} />
                     <Route path="/" element={<PublicRoute><Landing /></PublicRoute>} />
 
                     {/* Private routes (only accessible when logged in) */}
@@ -70,7 +70,7 @@ const Assignment = () => {
 
   const checkAdmin = async (email) => {
     try {
-      const res = await axios.post("http://localhost:8000/check-role", { email });
+      const res = await axios.post("http://localhost:8000/check-role");
       setIsAdmin(res.data.isAdmin);
     } catch (error) {
       console.error("Error checking admin role:", error);
@@ -94,6 +94,7 @@ const Assignment = () => {
         // User confirmed, proceed with deletion
         fetch(`http://localhost:8000/admin/course/${courseName}/deleteassignment/${assignmentName}`, {
           method: 'DELETE',
+          headers: { Authorization: `Bearer ${localStorage.getItem("token")}` },
         })
           .then(response => {
             if (!response.ok) {
@@ -185,7 +186,7 @@ const Assignment = () => {
   const checkSubmissionStatus = async (courseName, assignmentName) => {
     try {
       const response = await axios.post(
-        `http://localhost:8000/students/${studentName}/courses/${courseName}/assignments/${assignmentName}/checksubmission`
+        `http://localhost:8000/courses/${courseName}/assignments/${assignmentName}/checksubmission`
       );
       if (response.data.message === "Submitted") {
         return {
@@ -268,7 +269,7 @@ const Assignment = () => {
 
     try {
       await axios.post(
-        `http://localhost:8000/students/${studentName}/courses/${selectedCourse.name}/assignments/${assignment.name}/upload`,
+        `http://localhost:8000/courses/${selectedCourse.name}/assignments/${assignment.name}/upload`,
         formData,
         {
           headers: { "Content-Type": "multipart/form-data" },
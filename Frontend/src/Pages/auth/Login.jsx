@@ -1,4 +1,4 @@
-import { useState } from "react";
+import { useEffect, useState } from "react";
 import { BsEnvelope, BsLock, BsEye, BsEyeSlash, BsArrowLeft } from "react-icons/bs";
 import { Link, useNavigate } from "react-router-dom";
 import axios from "axios";
@@ -27,6 +27,49 @@ function LogIn() {
   const [confirmPassword, setConfirmPassword] = useState("");
   const [showResetForm, setShowResetForm] = useState(false);
   const [resetOtpPurpose, setResetOtpPurpose] = useState(""); // "verify_email" or "reset_password"
+  const [resetToken, setResetToken] = useState("");
+  const [challengeToken, setChallengeToken] = useState(""); // second login step with an authenticator app
+  const [ssoEnabled, setSsoEnabled] = useState(false);
+
+  // Offer single sign-on when the backend has it, and finish an SSO login
+  // when the identity provider sends the browser back here
+  useEffect(() => {
+    axios.get("http://localhost:8000/auth/oidc/config")
+      .then((res) => setSsoEnabled(res.data.enabled === true))
+      .catch(() => setSsoEnabled(false));
+
+    const params = new URLSearchParams(window.location.hash.slice(1));
+    if (!params.get("sso") && !params.get("ssoError")) {
+      return;
+    }
+    window.history.replaceState(null, "", window.location.pathname);
+    if (params.get("ssoError")) {
+      setError(params.get("ssoError"));
+      return;
+    }
+    const email = params.get("email") || "";
+    setFormData((data) => ({ ...data, email }));
+    axios.post("http://localhost:8000/auth/oidc/exchange", { challengeToken: params.get("sso") })
+      .then(async (res) => {
+        if (res.data.twoFactorRequired) {
+          if (res.data.twoFactorSetupRequired) {
+            setError("Two-factor authentication is required for your account. Please set it up before logging in.");
+          } else {
+            setChallengeToken(res.data.challengeToken);
+            setResetOtpPurpose("totp");
+            setShowOtpInput(true);
+          }
+          return;
+        }
+        setToken(res.data.token);
+        localStorage.setItem("token", res.data.token);
+        localStorage.setItem("refreshToken", res.data.refreshToken);
+        localStorage.setItem("email", email);
+        await checkUserRole(email);
+        navigate("/dashboard");
+      })
+      .catch(() => setError("Single sign-on failed. Please try again."));
+  }, []);
   
   function handleUserInput(e) {
     const { name, value } = e.target;
@@ -45,10 +88,22 @@ function LogIn() {
         password: formData.password,
       });
 
+      if (res.data && res.data.twoFactorRequired) {
+        if (res.data.twoFactorSetupRequired) {
+          setError("Two-factor authentication is required for your account. Please set it up before logging in.");
+        } else {
+          setChallengeToken(res.data.challengeToken);
+          setResetOtpPurpose("totp");
+          setShowOtpInput(true);
+        }
+        return;
+      }
+
       if (res.data && res.data.token) {
         const authToken = res.data.token;
         setToken(authToken);
         localStorage.setItem("token", authToken);
+        localStorage.setItem("refreshToken", res.data.refreshToken);
         localStorage.setItem("email", formData.email);
 
         // Request OTP after successful login
@@ -76,14 +131,18 @@ function LogIn() {
   }
 
   const resendOtp = async () => {
+    if (resetOtpPurpose === "totp") {
+      return false; // authenticator codes cannot be resent
+    }
     setIsLoading(true);
     try {
       const email = resetOtpPurpose === "reset_password" ? forgotPasswordEmail : formData.email;
       const headers = token ? { headers: { Authorization: `Bearer ${token}` } } : {};
       
+      const purpose = resetOtpPurpose === "reset_password" ? "reset_password" : undefined;
       const otpRes = await axios.post(
         "http://localhost:8000/request-otp1",
-        { email },
+        { email, purpose },
         headers
       );
       
@@ -106,17 +165,30 @@ function LogIn() {
   const onOtpSubmit = async (otp) => {
     setIsLoading(true);
     try {
+      if (resetOtpPurpose === "totp") {
+        const res = await axios.post("http://localhost:8000/login/2fa", { challengeToken, code: otp });
+        setToken(res.data.token);
+        localStorage.setItem("token", res.data.token);
+        localStorage.setItem("refreshToken", res.data.refreshToken);
+        localStorage.setItem("email", formData.email);
+        await checkUserRole(formData.email);
+        navigate("/dashboard");
+        return;
+      }
+
       const email = resetOtpPurpose === "reset_password" ? forgotPasswordEmail : formData.email;
       const headers = token ? { headers: { Authorization: `Bearer ${token}` } } : {};
       
+      const purpose = resetOtpPurpose === "reset_password" ? "reset_password" : undefined;
       const verifyRes = await axios.post(
         "http://localhost:8000/verify-otp1",
-        { email, otp },
+        { email, otp, purpose },
         headers
       );
       
       if (verifyRes.data) {
         if (resetOtpPurpose === "reset_password") {
+          setResetToken(verifyRes.data.resetToken);
           setShowResetForm(true); // Show the password reset form
           setShowOtpInput(false);
         } else {
@@ -143,7 +215,8 @@ function LogIn() {
     try {
       // Use the existing OTP endpoint
       const response = await axios.post("http://localhost:8000/request-otp1", {
-        email: forgotPasswordEmail
+        email: forgotPasswordEmail,
+        purpose: "reset_password"
       });
       
       if (response.data) {
@@ -167,8 +240,8 @@ const handlePasswordReset = async (e) => {
   setIsLoading(true);
   
   // Validate passwords
-  if (!newPassword || newPassword.length < 6) {
-    setError("Password must be at least 6 characters");
+  if (!newPassword) {
+    setError("Please enter a new password");
     setIsLoading(false);
     return;
   }
@@ -182,7 +255,7 @@ const handlePasswordReset = async (e) => {
   try {
     // Make sure the API call matches exactly what the backend expects
     const response = await axios.post("http://localhost:8000/forgotpassword", {
-      email: forgotPasswordEmail,
+      resetToken: resetToken,
       newPassword: newPassword
     });
     
@@ -218,7 +291,11 @@ const handlePasswordReset = async (e) => {
           </button>
           
           <h1>Verification Required</h1>
-          <p>We've sent a verification code to <strong>{resetOtpPurpose === "reset_password" ? forgotPasswordEmail : formData.email}</strong></p>
+          {resetOtpPurpose === "totp" ? (
+            <p>Enter the code from your authenticator app</p>
+          ) : (
+            <p>We've sent a verification code to <strong>{resetOtpPurpose === "reset_password" ? forgotPasswordEmail : formData.email}</strong></p>
+          )}
           
           <OtpInput 
             length={6} 
@@ -360,6 +437,12 @@ const handlePasswordReset = async (e) => {
                 }}>Forgot Password?</a>
               </p>
             )}
+
+            {!showForgotPassword && ssoEnabled && (
+              <p className="footer-text">
+                <a href="http://localhost:8000/auth/oidc/login">Sign in with your school account</a>
+              </p>
+            )}
             
             {showForgotPassword && (
               <p className="footer-text">
@@ -384,7 +467,7 @@ const handlePasswordReset = async (e) => {
               showResetForm ? (
                 <>
                   <p>Choose a strong password that you haven't used before.</p>
-                  <p>Your password should be at least 6 characters long and include a mix of numbers, letters, and symbols for better security.</p>
+                  <p>Your password should be at least 8 characters long, mix letters with numbers or symbols, and not contain your username or email.</p>
                 </>
               ) : (
                 <>
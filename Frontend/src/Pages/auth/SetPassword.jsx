@@ -0,0 +1,118 @@
+import { useState } from "react";
+import { BsLock, BsEye, BsEyeSlash } from "react-icons/bs";
+import { Link, useNavigate, useSearchParams } from "react-router-dom";
+import axios from "axios";
+import "./Login.css";
+
+// Landing page for invitation emails: the link carries a single-use token
+// that lets the invited user choose their first password.
+function SetPassword() {
+  const [searchParams] = useSearchParams();
+  const resetToken = searchParams.get("token") || "";
+  const [newPassword, setNewPassword] = useState("");
+  const [confirmPassword, setConfirmPassword] = useState("");
+  const [showPassword, setShowPassword] = useState(false);
+  const [error, setError] = useState("");
+  const [success, setSuccess] = useState("");
+  const [isLoading, setIsLoading] = useState(false);
+  const navigate = useNavigate();
+
+  const handleSubmit = async (e) => {
+    e.preventDefault();
+    setError("");
+
+    if (!newPassword) {
+      setError("Please enter a new password");
+      return;
+    }
+    if (newPassword !== confirmPassword) {
+      setError("Passwords do not match");
+      return;
+    }
+
+    setIsLoading(true);
+    try {
+      await axios.post("http://localhost:8000/forgotpassword", {
+        resetToken: resetToken,
+        newPassword: newPassword,
+      });
+      setSuccess("Your password is set! You can now log in.");
+      setTimeout(() => navigate("/login"), 3000);
+    } catch (err) {
+      setError(err.response?.data?.error || "Failed to set password. Please try again.");
+    } finally {
+      setIsLoading(false);
+    }
+  };
+
+  return (
+    <div className="login-container">
+      <form onSubmit={handleSubmit} className="login-form">
+        <div className="form-content">
+          <div>
+            <h1>Set Your Password</h1>
+          </div>
+          <hr />
+
+          {resetToken ? (
+            <>
+              <div className="input-group password-field">
+                <label htmlFor="newPassword">
+                  <BsLock />
+                </label>
+                <input
+                  type={showPassword ? "textbox" : "password"}
+                  id="newPassword"
+                  placeholder="New Password"
+                  value={newPassword}
+                  onChange={(e) => setNewPassword(e.target.value)}
+                  required
+                />
+                <span
+                  onClick={() => setShowPassword(!showPassword)}
+                  style={{ cursor: "pointer", marginLeft: "10px" }}
+                >
+                  {showPassword ? <BsEyeSlash size={24} /> : <BsEye size={24} />}
+                </span>
+              </div>
+
+              <div className="input-group password-field">
+                <label htmlFor="confirmPassword">
+                  <BsLock />
+                </label>
+                <input
+                  type={showPassword ? "textbox" : "password"}
+                  id="confirmPassword"
+                  placeholder="Confirm Password"
+                  value={confirmPassword}
+                  onChange={(e) => setConfirmPassword(e.target.value)}
+                  required
+                />
+              </div>
+
+              {error && <p className="error-text">{error}</p>}
+              {success && <p className="success-text">{success}</p>}
+
+              <button type="submit" className="login-btn" disabled={isLoading || success !== ""}>
+                {isLoading ? "Saving..." : "Set Password"}
+              </button>
+            </>
+          ) : (
+            <p className="error-text">This link is missing its token. Please use the link from your invitation email.</p>
+          )}
+
+          <p className="footer-text">
+            <Link to={"/login"}>Back to Login</Link>
+          </p>
+        </div>
+
+        <div className="welcome-message">
+          <p>An account has been created for you.</p>
+          <p>Choose a password of at least 8 characters, mixing letters with numbers or symbols, to finish setting it up. Invitation links expire, so ask your administrator for a new one if this one no longer works.</p>
+        </div>
+      </form>
+    </div>
+  );
+}
+
+export default SetPassword;
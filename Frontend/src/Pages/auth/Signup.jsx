@@ -35,18 +35,20 @@ function SignUp() {
     setIsLoading(true);
     
     try {
-      // Request OTP
-      const otpRes = await axios.post("http://localhost:8000/request-otp1", {
+      // Register the account; the backend emails a verification OTP
+      const registerRes = await axios.post("http://localhost:8000/register", {
+        username: signUpData.name,
         email: signUpData.email,
+        password: signUpData.password,
       });
 
-      if (otpRes.data) {
+      if (registerRes.data.success) {
         setShowOtpInput(true);
       } else {
-        setError("Failed to send OTP. Please try again later.");
+        setError(registerRes.data.message || "Registration failed. Please try again.");
       }
     } catch (err) {
-      setError("Something went wrong. Please try again.");
+      setError(err.response?.data?.error || "Something went wrong. Please try again.");
     } finally {
       setIsLoading(false);
     }
@@ -56,7 +58,7 @@ function SignUp() {
     setIsLoading(true);
     try {
       const otpRes = await axios.post(
-        "http://localhost:8000/request-otp1",
+        "http://localhost:8000/verify-email/resend",
         { email: signUpData.email }
       );
       
@@ -76,30 +78,19 @@ function SignUp() {
   const onOtpSubmit = async (otp) => {
     setIsLoading(true);
     try {
-      // Verify OTP
+      // Verify the email to activate the account
       const verifyRes = await axios.post(
-        "http://localhost:8000/verify-otp1",
+        "http://localhost:8000/verify-email",
         { email: signUpData.email, otp }
       );
       
       if (verifyRes.data) {
-        // Register the user after OTP verification
-        const registerRes = await axios.post("http://localhost:8000/register", {
-          username: signUpData.name,
-          email: signUpData.email,
-          password: signUpData.password,
-        });
+        // Add success animation or notification here
+        setTimeout(() => {
+          console.log("Registration success. Redirecting to login...");
 
-        if (registerRes.data.success) {
-          // Add success animation or notification here
-          setTimeout(() => {
-            console.log("Registration success. Redirecting to login...");
-
-            navigate("/login"); // Redirect to login after successful registration
-          }, 500);
-        } else {
-          setError(registerRes.data.message || "Registration failed. Please try again.");
-        }
+          navigate("/login"); // Redirect to login after successful verification
+        }, 500);
       } else {
         setError("Invalid OTP! Please try again.");
       }
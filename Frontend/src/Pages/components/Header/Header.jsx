@@ -52,6 +52,7 @@ const Header = () => {
     )
       .then(() => {
         localStorage.removeItem("token");
+        localStorage.removeItem("refreshToken");
         localStorage.removeItem("email");
         navigate("/login");
       })
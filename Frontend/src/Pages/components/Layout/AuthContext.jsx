@@ -16,7 +16,7 @@ export const AuthProvider = ({ children }) => {
 
         if (email && token) {
             checkUserRole(email); // If email and token exist, check the user's role
-            fetchProfilePhoto(email); // Also fetch the profile photo if available
+            fetchProfilePhoto(); // Also fetch the profile photo if available
         }
     }, []);
 
@@ -27,7 +27,7 @@ export const AuthProvider = ({ children }) => {
 
         try {
             // Fetch user role from the backend using check-role API
-            const roleRes = await axios.post("http://localhost:8000/check-role", { email });
+            const roleRes = await axios.post("http://localhost:8000/check-role");
             console.log("Role API Response:", roleRes.data);
             const isAdmin = roleRes.data?.isAdmin === true;
 
@@ -44,46 +44,41 @@ export const AuthProvider = ({ children }) => {
         }
     };
 
-    // Fetch profile photo for the user
-    const fetchProfilePhoto = async (email) => {
+    // Fetch profile photo for the user. It is only served with the auth
+    // header, so it is loaded as a blob rather than linked from an <img>.
+    const fetchProfilePhoto = async () => {
         try {
-            const encodedEmail = encodeURIComponent(email);
-            const detailsResponse = await axios.get(`http://localhost:8000/userdetails/${encodedEmail}`);
-            
-            if (detailsResponse.data.details && detailsResponse.data.details.photo_path) {
-                const timestamp = Date.now();
-                const photoUrl = `http://localhost:8000/uploads/${encodeURIComponent(email.replace('@', '_at_').replace('.', '_dot_'))}/photo.jpg?t=${timestamp}`;
-                setProfilePhotoUrl(photoUrl);
-                setUpdateTimestamp(timestamp);
-            }
+            const photoResponse = await axios.get("http://localhost:8000/me/photo", { responseType: "blob" });
+            const photoUrl = URL.createObjectURL(photoResponse.data);
+            updateProfilePhoto(photoUrl);
+            return photoUrl;
         } catch (error) {
-            console.error("Failed to fetch profile photo:", error);
+            if (error.response?.status !== 404) {
+                console.error("Failed to fetch profile photo:", error);
+            }
             // Don't set error state as this isn't critical
+            updateProfilePhoto(null);
+            return null;
         }
     };
 
-    // Update profile photo URL with cache busting
+    // Update profile photo URL, releasing the previous blob
     const updateProfilePhoto = (photoUrl) => {
-        const timestamp = Date.now();
-        
-        // If photoUrl already contains a timestamp parameter, replace it
-        if (photoUrl && photoUrl.includes('?t=')) {
-            photoUrl = photoUrl.split('?t=')[0] + `?t=${timestamp}`;
-        } 
-        // If photoUrl doesn't contain a timestamp yet, add it
-        else if (photoUrl) {
-            photoUrl = `${photoUrl}?t=${timestamp}`;
-        }
-        
-        setProfilePhotoUrl(photoUrl);
-        setUpdateTimestamp(timestamp);
+        setProfilePhotoUrl((previous) => {
+            if (previous && previous !== photoUrl && previous.startsWith("blob:")) {
+                URL.revokeObjectURL(previous);
+            }
+            return photoUrl;
+        });
+        setUpdateTimestamp(Date.now());
     };
 
     const logout = () => {
         setUser(null);
         setError(null); // Clear any previous error when logging out
-        setProfilePhotoUrl(null); // Clear profile photo URL
+        updateProfilePhoto(null); // Clear profile photo URL
         localStorage.removeItem("token"); // Remove token and email from localStorage
+        localStorage.removeItem("refreshToken");
         localStorage.removeItem("email");
     };
 
@@ -96,7 +91,8 @@ export const AuthProvider = ({ children }) => {
             error, 
             profilePhotoUrl,
             updateTimestamp, 
-            updateProfilePhoto 
+            updateProfilePhoto,
+            fetchProfilePhoto
         }}>
             {children}
         </AuthContext.Provider>
@@ -4,7 +4,7 @@ import axios from 'axios';
 import './UserProfile.css';
 
 export default function UserProfile() {
-  const { user, updateProfilePhoto } = useAuth();
+  const { user, profilePhotoUrl, fetchProfilePhoto } = useAuth();
   const [userDetails, setUserDetails] = useState(null);
   const [username, setUsername] = useState('');
   const [loading, setLoading] = useState(true);
@@ -54,8 +54,7 @@ export default function UserProfile() {
     try {
       // Fetch user details
       console.log(`Fetching user details for email: ${user.email}`);
-      const encodedEmail = encodeURIComponent(user.email);
-      const detailsResponse = await axios.get(`http://localhost:8000/userdetails/${encodedEmail}`);
+      const detailsResponse = await axios.get(`http://localhost:8000/me/details`);
       console.log('User details fetched successfully:', detailsResponse.data);
       setUserDetails(detailsResponse.data.details);
 
@@ -74,22 +73,13 @@ export default function UserProfile() {
           grade: details.grade || '',
         });
 
-        // Set photo preview if available
-        if (details.photo_path) {
-          const photoUrl = `http://localhost:8000/uploads/${encodeURIComponent(user.email.replace('@', '_at_').replace('.', '_dot_'))}/photo.jpg`;
-          setPhotoPreview(photoUrl);
-          
-          // ADD THIS LINE - Update the profile photo in AuthContext
-          updateProfilePhoto(photoUrl);
-        } else {
-          // ADD THIS LINE - Clear the profile photo in AuthContext if none exists
-          updateProfilePhoto(null);
-        }
+        // Set photo preview if available; this also updates the photo in AuthContext
+        setPhotoPreview(details.photo_path ? await fetchProfilePhoto() : null);
       }
 
       // Fetch username
       console.log(`Fetching username for email: ${user.email}`);
-      const usernameResponse = await axios.get(`http://localhost:8000/username/email/${encodedEmail}`);
+      const usernameResponse = await axios.get("http://localhost:8000/me/username");
       console.log('Username fetched successfully:', usernameResponse.data);
       setUsername(usernameResponse.data.username);
 
@@ -131,7 +121,7 @@ export default function UserProfile() {
     setProfilePhoto(null);
     // Reset photo preview to current photo or null
     if (userDetails && userDetails.photo_path) {
-      setPhotoPreview(`http://localhost:8000/uploads/${encodeURIComponent(user.email.replace('@', '_at_').replace('.', '_dot_'))}/photo.jpg`);
+      setPhotoPreview(profilePhotoUrl);
     } else {
       setPhotoPreview(null);
     }
@@ -179,14 +169,9 @@ export default function UserProfile() {
       console.log('Details submitted successfully:', response.data);
       setSubmitSuccess('Details submitted successfully!');
 
-      // Set photoPreview immediately with a timestamp to force refresh
+      // Load the new photo right away, also updating it in AuthContext
       if (profilePhoto) {
-        const timestamp = new Date().getTime();
-        const photoUrl = `http://localhost:8000/uploads/${encodeURIComponent(user.email.replace('@', '_at_').replace('.', '_dot_'))}/photo.jpg?t=${timestamp}`;
-        setPhotoPreview(photoUrl);
-        
-        // ADD THIS LINE - Update the profile photo in AuthContext
-        updateProfilePhoto(photoUrl);
+        setPhotoPreview(await fetchProfilePhoto());
       }
 
 
@@ -413,7 +398,7 @@ export default function UserProfile() {
               {userDetails && userDetails.photo_path ? (
                 <div className="avatar-img">
                   <img
-                    src={`http://localhost:8000/uploads/${encodeURIComponent(user.email.replace('@', '_at_').replace('.', '_dot_'))}/photo.jpg?t=${new Date().getTime()}`}
+                    src={profilePhotoUrl}
                     alt="Profile"
                   />
                 </div>
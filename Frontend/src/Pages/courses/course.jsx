@@ -39,7 +39,7 @@ export default function CourseManagement() {
 
   const checkAdmin = async (email) => {
     try {
-      const res = await axios.post("http://localhost:8000/check-role", { email });
+      const res = await axios.post("http://localhost:8000/check-role");
       setIsAdmin(res.data?.isAdmin || false);
     } catch (error) {
       console.error("Error checking admin role:", error);
@@ -63,7 +63,7 @@ export default function CourseManagement() {
         let fetchOptions = {
           method: 'DELETE',
         };
-        const authToken = localStorage.getItem('authToken');
+        const authToken = localStorage.getItem('token');
         if (authToken) {
           fetchOptions.headers = { 'Authorization': `Bearer ${authToken}` };
         }
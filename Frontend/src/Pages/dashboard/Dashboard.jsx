@@ -33,7 +33,7 @@ const Dashboard = () => {
   }, [refreshKey]);
   const fetchUsername = async (email) => {
     try {
-      const response = await axios.get(`http://localhost:8000/username/email/${email}`);
+      const response = await axios.get("http://localhost:8000/me/username");
       setUsername(response.data.username);
     } catch (err) {
       // Handle error silently or set a default username
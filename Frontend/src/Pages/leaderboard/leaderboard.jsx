@@ -15,7 +15,7 @@ const Leaderboard = () => {
     }, []);
   const checkAdmin = async (email) => {
     try {
-      const res = await axios.post("http://localhost:8000/check-role", { email });
+      const res = await axios.post("http://localhost:8000/check-role");
       setIsAdmin(res.data.isAdmin);
     } catch (error) {
       console.error("Error checking admin role:", error);
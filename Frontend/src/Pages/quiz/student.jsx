@@ -52,7 +52,7 @@ function StudentDashboard() {
 
   const fetchUsername = async (email) => {
     try {
-      const response = await axios.get(`http://localhost:8000/username/email/${email}`);
+      const response = await axios.get("http://localhost:8000/me/username");
       setUsername(response.data.username);
     } catch (err) {
       // Handle error silently or set a default username
@@ -92,14 +92,14 @@ function StudentDashboard() {
       console.log("Fetching student progress for email:", email);
       
       // Make the API call with error handling
-      const response = await axios.get(`http://localhost:8000/admin/student-progress/email/${email}`, {
+      const response = await axios.get(`http://localhost:8000/student-progress`, {
         // Add timeout to prevent hanging requests
         timeout: 5000,
         // Add headers if needed for authentication
         headers: {
           'Content-Type': 'application/json',
           // Add auth token if you have one stored
-          'Authorization': `Bearer ${localStorage.getItem('authToken') || ''}`
+          'Authorization': `Bearer ${localStorage.getItem('token') || ''}`
         }
       });
       
@@ -153,7 +153,7 @@ function StudentDashboard() {
   const fetchQuizResults = async (quizId) => {
     try {
       setLoading(true);
-      const response = await axios.get(`http://localhost:8000/results/email/${studentEmail}/quizid/${quizId}`);
+      const response = await axios.get(`http://localhost:8000/results/quizid/${quizId}`);
       setQuizResults(response.data);
       setLoading(false);
     } catch (err) {
@@ -201,7 +201,7 @@ function StudentDashboard() {
 
   const checkSubmissionStatus = async (quizId) => {
     try {
-      const response = await axios.get(`http://localhost:8000/checkquizSubmission/${quizId}/${studentEmail}`);
+      const response = await axios.get(`http://localhost:8000/checkquizSubmission/${quizId}`);
       if (response.data.submitted) {
         // Already submitted, show results instead
         fetchQuizResults(quizId);
@@ -1,7 +1,39 @@
 import { StrictMode } from 'react'
 import { createRoot } from 'react-dom/client'
+import axios from 'axios'
 import App from './App.jsx'
 
+// Attach the stored token to every API request so protected routes work
+axios.interceptors.request.use((config) => {
+  const token = localStorage.getItem('token')
+  if (token && !config.headers.Authorization) {
+    config.headers.Authorization = `Bearer ${token}`
+  }
+  return config
+})
+
+// Access tokens are short-lived: on a 401 try once to swap the refresh token
+// for a new pair, then replay the original request
+axios.interceptors.response.use(undefined, async (error) => {
+  const original = error.config
+  const refreshToken = localStorage.getItem('refreshToken')
+  if (error.response?.status !== 401 || !refreshToken || original._retried || original.url.endsWith('/token/refresh')) {
+    return Promise.reject(error)
+  }
+  original._retried = true
+  try {
+    const res = await axios.post('http://localhost:8000/token/refresh', { refreshToken })
+    localStorage.setItem('token', res.data.token)
+    localStorage.setItem('refreshToken', res.data.refreshToken)
+    original.headers.Authorization = `Bearer ${res.data.token}`
+    return axios(original)
+  } catch (refreshError) {
+    localStorage.removeItem('token')
+    localStorage.removeItem('refreshToken')
+    return Promise.reject(error)
+  }
+})
+
 createRoot(document.getElementById('root')).render(
   <StrictMode>
     <App />